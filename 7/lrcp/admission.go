@@ -0,0 +1,138 @@
+package lrcp
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Reasons a Listener refuses a connect.
+var (
+	errMaxSessions          = errors.New("too many sessions")
+	errMaxSessionsPerSource = errors.New("too many sessions from source")
+	errConnectRate          = errors.New("connect rate exceeded for source")
+)
+
+// How often idle token buckets are swept out of rateLimiter.buckets.
+const bucketSweepInterval = 10 * time.Second
+
+// admission enforces a Listener's limits on new sessions (see Config.)
+// Sources are identified by IP address (see sourceKey.)
+// Refused connects get no reply, so a well-behaved peer simply retries later.
+type admission struct {
+	lock sync.Mutex
+
+	maxSessions          int
+	maxSessionsPerSource int
+
+	sessions  int
+	perSource map[string]int
+	// connects is nil if ConnectRate is unlimited.
+	connects *rateLimiter
+}
+
+func newAdmission(config Config) *admission {
+	a := &admission{
+		maxSessions:          config.MaxSessions,
+		maxSessionsPerSource: config.MaxSessionsPerSource,
+		perSource:            make(map[string]int),
+	}
+	if config.ConnectRate > 0 {
+		a.connects = newRateLimiter(config.ConnectRate, config.ConnectBurst)
+	}
+	return a
+}
+
+// admit reserves a session slot for source, or returns the reason it can't.
+// Each successful admit must be paired with a release.
+func (a *admission) admit(source string, now time.Time) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.maxSessions > 0 && a.sessions >= a.maxSessions {
+		return errMaxSessions
+	}
+	if a.maxSessionsPerSource > 0 && a.perSource[source] >= a.maxSessionsPerSource {
+		return errMaxSessionsPerSource
+	}
+	if a.connects != nil && !a.connects.allow(source, now) {
+		return errConnectRate
+	}
+	a.sessions++
+	a.perSource[source]++
+	return nil
+}
+
+// release frees the session slot reserved for source by admit.
+func (a *admission) release(source string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.sessions--
+	if a.perSource[source]--; a.perSource[source] <= 0 {
+		delete(a.perSource, source)
+	}
+}
+
+// rateLimiter allows each source rate events per second on average, in bursts of up to burst,
+// with a token bucket per source. Not safe for concurrent use.
+type rateLimiter struct {
+	rate      float64
+	burst     float64
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(max(burst, 1)),
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// allow reports whether source may have another event now, consuming a token if so.
+func (r *rateLimiter) allow(source string, now time.Time) bool {
+	r.sweep(now)
+	b, ok := r.buckets[source]
+	if !ok {
+		b = &tokenBucket{tokens: r.burst, last: now}
+		r.buckets[source] = b
+	}
+	return b.take(now, r.rate, r.burst)
+}
+
+// sweep drops buckets that have refilled, since a fresh bucket behaves the same,
+// so that a stream of events from many sources doesn't grow the map forever.
+func (r *rateLimiter) sweep(now time.Time) {
+	if now.Sub(r.lastSweep) < bucketSweepInterval {
+		return
+	}
+	r.lastSweep = now
+	for source, b := range r.buckets {
+		if b.refill(now, r.rate, r.burst) >= r.burst {
+			delete(r.buckets, source)
+		}
+	}
+}
+
+// tokenBucket allows rate events per second on average, in bursts of up to burst.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// refill adds the tokens accrued since the last refill and returns the new total.
+func (b *tokenBucket) refill(now time.Time, rate, burst float64) float64 {
+	b.tokens = min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	return b.tokens
+}
+
+// take consumes a token if one is available.
+func (b *tokenBucket) take(now time.Time, rate, burst float64) bool {
+	if b.refill(now, rate, burst) < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
@@ -0,0 +1,100 @@
+package lrcp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAdmission(t *testing.T) {
+	now := time.Now()
+
+	t.Run("session limits", func(t *testing.T) {
+		a := newAdmission(Config{MaxSessions: 3, MaxSessionsPerSource: 2})
+		for _, source := range []string{"a", "a", "b"} {
+			if err := a.admit(source, now); err != nil {
+				t.Fatalf("unexpected refusal for %s: %v", source, err)
+			}
+		}
+		if err := a.admit("b", now); !errors.Is(err, errMaxSessions) {
+			t.Fatalf("expected errMaxSessions, got %v", err)
+		}
+		a.release("b")
+		if err := a.admit("a", now); !errors.Is(err, errMaxSessionsPerSource) {
+			t.Fatalf("expected errMaxSessionsPerSource, got %v", err)
+		}
+		if err := a.admit("c", now); err != nil {
+			t.Fatalf("unexpected refusal after release: %v", err)
+		}
+	})
+
+	t.Run("connect rate", func(t *testing.T) {
+		a := newAdmission(Config{ConnectRate: 10, ConnectBurst: 3})
+		for i := 0; i < 3; i++ {
+			if err := a.admit("a", now); err != nil {
+				t.Fatalf("unexpected refusal within burst: %v", err)
+			}
+		}
+		if err := a.admit("a", now); !errors.Is(err, errConnectRate) {
+			t.Fatalf("expected errConnectRate, got %v", err)
+		}
+		// Other sources have their own bucket.
+		if err := a.admit("b", now); err != nil {
+			t.Fatalf("unexpected refusal for another source: %v", err)
+		}
+		// One token accrues every 100ms.
+		if err := a.admit("a", now.Add(100*time.Millisecond)); err != nil {
+			t.Fatalf("unexpected refusal after refill: %v", err)
+		}
+		if err := a.admit("a", now.Add(100*time.Millisecond)); !errors.Is(err, errConnectRate) {
+			t.Fatalf("expected errConnectRate, got %v", err)
+		}
+
+		// Refilled buckets are swept.
+		a.admit("c", now.Add(time.Hour))
+		if _, ok := a.connects.buckets["a"]; ok {
+			t.Fatal("expected refilled bucket to be swept")
+		}
+	})
+}
+
+// TestListenerAdmission checks that a Listener ignores connects over its limits, and counts them.
+func TestListenerAdmission(t *testing.T) {
+	l, err := Listen("lrcp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")}, &Config{MaxSessionsPerSource: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	d := &Dialer{Timeout: 5 * time.Second}
+	defer d.Close()
+	first, err := d.Dial("lrcp", l.Addr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("unexpected dial error: %v", err)
+	}
+	if _, err := d.Dial("lrcp", l.Addr().(*net.UDPAddr)); err != nil {
+		t.Fatalf("unexpected dial error: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if _, err := d.DialContext(ctx, "lrcp", l.Addr().(*net.UDPAddr)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected third session from one source to be ignored, got %v", err)
+	}
+	if got := l.Stats().RejectedMaxSessionsPerSource; got < 1 {
+		t.Fatalf("expected rejected connects to be counted, got %d", got)
+	}
+
+	// Aborting frees the slot, even though Abort doesn't notify anyone.
+	accepted, err := l.AcceptLRCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted.Abort()
+	first.Abort()
+	if _, err := d.Dial("lrcp", l.Addr().(*net.UDPAddr)); err != nil {
+		t.Fatalf("unexpected dial error after freeing a slot: %v", err)
+	}
+}
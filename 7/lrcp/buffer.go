@@ -0,0 +1,24 @@
+package lrcp
+
+// Initial capacity of a Session's read and write buffers. Buffers are never shrunk below this.
+const minBufferSize = 1024
+
+// discard drops the first n bytes of buf, returning the new buffer and the number of bytes dropped.
+// This lets a Session's buffers act as a sliding window over the stream, so memory use tracks the
+// data still held rather than everything that has passed through.
+//
+// Nothing is dropped until the discarded bytes make up at least half the buffer, so the cost
+// of copying the remainder down is amortized over the reads or acks that consumed them.
+// If the buffer is left mostly empty, it's reallocated at a smaller size.
+func discard(buf []byte, n int) ([]byte, int) {
+	if n <= 0 || n < len(buf)-n {
+		return buf, 0
+	}
+	rest := len(buf) - n
+	if c := cap(buf); c > minBufferSize && rest < c/4 {
+		shrunk := make([]byte, rest, max(minBufferSize, 2*rest))
+		copy(shrunk, buf[n:])
+		return shrunk, n
+	}
+	return buf[:copy(buf, buf[n:])], n
+}
@@ -0,0 +1,350 @@
+package lrcp
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// A Dialer contains options for dialing LRCP sessions, and tracks the sessions it has dialed.
+// The zero value is ready to use. A Dialer is safe for concurrent use by multiple goroutines,
+// and must not be copied after first use.
+type Dialer struct {
+	// LocalAddr is the local address to dial from.
+	// If nil, a local address and port are automatically chosen.
+	LocalAddr *net.UDPAddr
+
+	// Timeout is the maximum amount of time a dial will wait for the server to
+	// acknowledge the connect. Zero means no timeout, beyond that of the context.
+	Timeout time.Duration
+
+	// Config tunes dialed sessions; nil uses the defaults.
+	Config *Config
+
+	// Multiplex, if set, runs every session dialed with Dial or DialContext over one
+	// socket per network (bound to LocalAddr) instead of opening a socket per session.
+	// Incoming messages are demultiplexed by session ID, as Listener does for servers.
+	// The shared sockets stay open until Close.
+	Multiplex bool
+
+	// sessionStore maps IDs of sessions dialed by this Dialer to their Sessions.
+	// IDs are unique per Dialer, so they're enough to demultiplex a shared socket.
+	sessionStore sync.Map
+	// bufPool holds read buffers for the listen loops.
+	bufPool sync.Pool
+
+	// muxLock guards muxConns and closed.
+	muxLock sync.Mutex
+	// muxConns maps UDP networks to the sockets shared by multiplexed sessions.
+	muxConns map[string]net.PacketConn
+	closed   bool
+}
+
+// defaultDialer backs the package-level Dial functions.
+var defaultDialer = &Dialer{}
+
+// ErrConnectionRefused is returned (wrapped) by a dial when the server answers the connect
+// with a close. It wraps syscall.ECONNREFUSED, so errors.Is matches either, as with net.Dial.
+var ErrConnectionRefused = fmt.Errorf("server closed the session before acknowledging connect: %w", syscall.ECONNREFUSED)
+
+// Dial creates a new Session for an LRCP client, blocking until the server acknowledges
+// the connection. Equivalent to DialContext with a background context; see DialContext.
+func Dial(network string, laddr, raddr *net.UDPAddr) (*Session, error) {
+	return DialContext(context.Background(), network, laddr, raddr)
+}
+
+// DialContext creates a new Session for an LRCP client using a default Dialer.
+// Like net.Dial and related functions, `network` must be a valid LRCP network name:
+// "lrcp" (IPv4 or IPv6), "lrcp4" (IPv4 only) or "lrcp6" (IPv6 only.)
+// If laddr is nil, a local address and port are automatically chosen.
+//
+// DialContext blocks until the server acknowledges the connect message, resending it
+// on the usual retransmission schedule. It returns an error if ctx is done first,
+// if the server answers with a close (ErrConnectionRefused), or if the session expires
+// without a reply.
+func DialContext(ctx context.Context, network string, laddr, raddr *net.UDPAddr) (*Session, error) {
+	return defaultDialer.dialContext(ctx, network, laddr, raddr)
+}
+
+// DialPacketConn is like DialContext, but runs the session over an existing packet
+// connection using a default Dialer; see Dialer.DialPacketConn.
+func DialPacketConn(ctx context.Context, conn net.PacketConn, raddr net.Addr) (*Session, error) {
+	return defaultDialer.DialPacketConn(ctx, conn, raddr)
+}
+
+// Dial connects to raddr on the named network; see the package-level Dial.
+func (d *Dialer) Dial(network string, raddr *net.UDPAddr) (*Session, error) {
+	return d.DialContext(context.Background(), network, raddr)
+}
+
+// DialContext connects to raddr on the named network from d.LocalAddr;
+// see the package-level DialContext.
+func (d *Dialer) DialContext(ctx context.Context, network string, raddr *net.UDPAddr) (*Session, error) {
+	return d.dialContext(ctx, network, d.LocalAddr, raddr)
+}
+
+func (d *Dialer) dialContext(ctx context.Context, network string, laddr, raddr *net.UDPAddr) (*Session, error) {
+	udpNet, err := udpNetwork(network)
+	if err != nil {
+		return nil, err
+	}
+	if d.Multiplex {
+		conn, err := d.muxConn(udpNet, laddr)
+		if err != nil {
+			return nil, err
+		}
+		return d.connect(ctx, conn, false, raddr)
+	}
+	conn, err := net.ListenUDP(udpNet, laddr)
+	if err != nil {
+		return nil, err
+	}
+	return d.DialPacketConn(ctx, conn, raddr)
+}
+
+// DialPacketConn is like DialContext, but runs the session over an existing packet
+// connection, such as a unixgram socket or an in-memory pipe in tests.
+// conn must not be connected, since messages are sent with WriteTo; packets from
+// addresses other than raddr are ignored. d.LocalAddr is not used.
+// The session takes ownership of conn and closes it when the session ends,
+// including when DialPacketConn returns an error.
+func (d *Dialer) DialPacketConn(ctx context.Context, conn net.PacketConn, raddr net.Addr) (*Session, error) {
+	return d.connect(ctx, conn, true, raddr)
+}
+
+// connect dials raddr over conn and waits for the connect to be acknowledged.
+// If owned, conn belongs to the new session alone and is closed with it.
+func (d *Dialer) connect(ctx context.Context, conn net.PacketConn, owned bool, raddr net.Addr) (*Session, error) {
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
+	session, err := d.dial(conn, owned, raddr)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		// Grab the channel before checking, so we can't miss the ack in between.
+		acked := session.ackChanged()
+		if session.lastAck.Load() >= 0 {
+			log.Printf("DialContext: Session[%s] connected", session.Key())
+			return session, nil
+		}
+		select {
+		case <-ctx.Done():
+			session.shutdown()
+			return nil, fmt.Errorf("dial %s: %w", raddr, ctx.Err())
+		case <-session.ctx.Done():
+			if session.peerClosed.Load() {
+				return nil, fmt.Errorf("dial %s: %w", raddr, ErrConnectionRefused)
+			}
+			return nil, fmt.Errorf("dial %s: session closed before connect was acknowledged", raddr)
+		case <-acked:
+		}
+	}
+}
+
+// dial creates a new client Session over conn and sends its initial connect,
+// without waiting for a reply.
+func (d *Dialer) dial(conn net.PacketConn, owned bool, raddr net.Addr) (*Session, error) {
+	if owned {
+		d.muxLock.Lock()
+		closed := d.closed
+		d.muxLock.Unlock()
+		if closed {
+			conn.Close()
+			return nil, fmt.Errorf("dial %s: dialer closed: %w", raddr, net.ErrClosed)
+		}
+	}
+	log.Printf("Dial: dialing [%s], listening on [%s]", raddr, conn.LocalAddr())
+	cleanup := d.cleanup
+	if owned {
+		cleanup = d.cleanupOwned
+	}
+	id, err := d.getClientId()
+	if err != nil {
+		if owned {
+			conn.Close()
+		}
+		return nil, fmt.Errorf("dial %s: %w", raddr, err)
+	}
+	session := newSession(raddr,
+		id,
+		conn,
+		d.Config.withDefaults(),
+		cleanup,
+		true)
+	d.sessionStore.Store(session.ID, session)
+	if owned {
+		go d.listen(conn, session)
+	}
+	// Send initial connect before making session available for use
+	err = session.sendConnect()
+	if err != nil {
+		session.shutdown()
+		return nil, fmt.Errorf("error sending connect message on dial: %v", err)
+	}
+	return session, nil
+}
+
+// muxConn returns the socket shared by multiplexed sessions on udpNet, creating it on first use.
+func (d *Dialer) muxConn(udpNet string, laddr *net.UDPAddr) (net.PacketConn, error) {
+	d.muxLock.Lock()
+	defer d.muxLock.Unlock()
+	if d.closed {
+		return nil, fmt.Errorf("dialer closed: %w", net.ErrClosed)
+	}
+	if conn, ok := d.muxConns[udpNet]; ok {
+		return conn, nil
+	}
+	conn, err := net.ListenUDP(udpNet, laddr)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Dialer: multiplexing sessions over [%s]", conn.LocalAddr())
+	if d.muxConns == nil {
+		d.muxConns = make(map[string]net.PacketConn)
+	}
+	d.muxConns[udpNet] = conn
+	go d.listen(conn, nil)
+	return conn, nil
+}
+
+// Close closes every session dialed by d (notifying peers) and releases the sockets
+// shared by multiplexed sessions. Dialing with d afterwards fails.
+// Can be safely called multiple times.
+func (d *Dialer) Close() error {
+	d.muxLock.Lock()
+	defer d.muxLock.Unlock()
+	if d.closed {
+		return nil
+	}
+	d.closed = true
+	// Sessions still need the shared sockets to send their close messages, so close those last.
+	d.sessionStore.Range(func(_, value any) bool {
+		if s, ok := value.(*Session); ok {
+			s.shutdown()
+		}
+		return true
+	})
+	var err error
+	for _, conn := range d.muxConns {
+		err = errors.Join(err, conn.Close())
+	}
+	return err
+}
+
+// cleanup is a callback for sessions that have quit (for whatever reason).
+func (d *Dialer) cleanup(session *Session) {
+	log.Printf(`Dialer.cleanup: Session[%s] has quit. Removing from client session store.`, session.Key())
+	d.sessionStore.Delete(session.ID)
+}
+
+// cleanupOwned is cleanup for sessions with their own underlying conn, which goes with them.
+func (d *Dialer) cleanupOwned(session *Session) {
+	d.cleanup(session)
+	err := session.conn.Close()
+	if err != nil {
+		log.Printf(`Dialer.cleanup: error closing Session[%s]`, session.Key())
+	}
+}
+
+// getClientId produces a random session ID (an integer below 2147483648, the max LRCP
+// numeric size) that's not yet in use by a session of this Dialer, and reserves it.
+// IDs come from crypto/rand, so that an attacker spoofing our address can't guess them
+// (see the package documentation.)
+// Note that Listener.sessionStore maps Session.Key() so that clients on different IPs
+// can create sessions with colliding IDs. Multiplexed sessions share a socket and are
+// demultiplexed by ID alone, so a Dialer keeps IDs unique across all of its sessions.
+func (d *Dialer) getClientId() (int, error) {
+	// Numeric field, must be smaller than 2147483648
+	limit := big.NewInt(maxInt + 1)
+	for {
+		n, err := rand.Int(rand.Reader, limit)
+		if err != nil {
+			return 0, fmt.Errorf("error generating session ID: %w", err)
+		}
+		i := int(n.Int64())
+		// Placeholder until the session exists.
+		if _, loaded := d.sessionStore.LoadOrStore(i, struct{}{}); !loaded {
+			return i, nil
+		}
+	}
+}
+
+// listen is the core read loop for conn, demultiplexing incoming messages to the
+// client sessions using it. If owner is set, conn belongs to that session alone and
+// the loop exits with it; otherwise conn is shared and the loop exits once it's closed.
+func (d *Dialer) listen(conn net.PacketConn, owner *Session) {
+	bufPtr, ok := d.bufPool.Get().(*[]byte)
+	if !ok {
+		buf := make([]byte, maxMessageSize)
+		bufPtr = &buf
+	}
+	defer d.bufPool.Put(bufPtr)
+	buf := *bufPtr
+	for {
+		if owner != nil && owner.ctx.Err() != nil {
+			return
+		}
+
+		// Read a packet
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf(`Dialer.listen: error reading from [%s]: %v`, conn.LocalAddr(), err)
+			continue
+		}
+		rawMsg := buf[:n]
+
+		// Parse a message
+		parsedMsg, err := parseMessage(rawMsg)
+		if err != nil {
+			// Just drop invalid messages
+			log.Printf(`Dialer.listen: error parsing message from [%s]: [%v]`, addr, err)
+			continue
+		}
+		value, _ := d.sessionStore.Load(parsedMsg.Session)
+		s, ok := value.(*Session)
+		// The conn isn't connected, so anyone can send to it.
+		if !ok || s.conn != conn || addrKey(addr) != addrKey(s.addr) {
+			log.Printf(`Dialer.listen: ignoring [%s] for unknown session [%d] from [%s]`, parsedMsg.Type, parsedMsg.Session, addr)
+			continue
+		}
+		log.Printf(`Client[%s].listen: got %d bytes of type [%s]`, s.Key(), n, parsedMsg.Type)
+		s.stats.received(n)
+
+		switch parsedMsg.Type {
+		case `connect`:
+			// For now, we aren't supporting 1-1 connections, so just close.
+			log.Printf(`Client[%s].listen: unexpected connect from server`, s.Key())
+			s.shutdown()
+		case `close`:
+			log.Printf(`Client[%s].listen: peer disconnect; closing`, s.Key())
+			s.peerClosed.Store(true)
+			// Send a Close msg if we *haven't* already closed ourselves
+			s.shutdown()
+		case `ack`, `data`:
+			// Forward ACK and DATA to session.
+			// Don't acknowledge DATA yet, since we may drop packets here.
+			err = s.receive(parsedMsg)
+			if err != nil {
+				// Do nothing; just drop the packet.
+				log.Printf(`Client[%s].listen: dropped packet: %v`, s.Key(), err)
+			}
+		default:
+			log.Printf(`Client[%s].listen: unexpected packet type [%s]`, s.Key(), parsedMsg.Type)
+		}
+	}
+}
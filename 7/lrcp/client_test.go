@@ -0,0 +1,213 @@
+package lrcp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestDialContext(t *testing.T) {
+	t.Run("unknown network", func(t *testing.T) {
+		_, err := DialContext(context.Background(), "udp", nil, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1})
+		var unknown net.UnknownNetworkError
+		if !errors.As(err, &unknown) {
+			t.Fatalf("expected net.UnknownNetworkError, got %v", err)
+		}
+	})
+
+	t.Run("context expires while server is silent", func(t *testing.T) {
+		// Bind a socket that never answers.
+		silent, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer silent.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		_, err = DialContext(ctx, "lrcp", nil, silent.LocalAddr().(*net.UDPAddr))
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+		}
+	})
+
+	t.Run("server refuses with close", func(t *testing.T) {
+		refuser, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer refuser.Close()
+		go func() {
+			buf := make([]byte, maxMessageSize)
+			for {
+				n, addr, err := refuser.ReadFrom(buf)
+				if err != nil {
+					return
+				}
+				msg, err := parseMessage(buf[:n])
+				if err != nil || msg.Type != "connect" {
+					continue
+				}
+				refuser.WriteTo([]byte(fmt.Sprintf("/close/%d/", msg.Session)), addr)
+			}
+		}()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_, err = DialContext(ctx, "lrcp", nil, refuser.LocalAddr().(*net.UDPAddr))
+		if !errors.Is(err, ErrConnectionRefused) || !errors.Is(err, syscall.ECONNREFUSED) {
+			t.Fatalf("expected refusal error, got %v", err)
+		}
+	})
+
+	t.Run("connects once acknowledged", func(t *testing.T) {
+		l, err := Listen("lrcp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		s, err := DialContext(ctx, "lrcp4", nil, l.Addr().(*net.UDPAddr))
+		if err != nil {
+			t.Fatalf("unexpected dial error: %v", err)
+		}
+		defer s.Close()
+		if got := s.lastAck.Load(); got != 0 {
+			t.Fatalf("expected connect to be acked, lastAck is %d", got)
+		}
+	})
+}
+
+func TestDialer(t *testing.T) {
+	t.Run("timeout while server is silent", func(t *testing.T) {
+		silent, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer silent.Close()
+
+		d := &Dialer{Timeout: 100 * time.Millisecond}
+		_, err = d.Dial("lrcp", silent.LocalAddr().(*net.UDPAddr))
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+		}
+	})
+
+	t.Run("concurrent dials share one dialer", func(t *testing.T) {
+		l, err := Listen("lrcp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+
+		const n = 20
+		d := &Dialer{LocalAddr: &net.UDPAddr{IP: net.ParseIP("127.0.0.1")}, Timeout: 5 * time.Second}
+		sessions := make(chan *Session, n)
+		errs := make(chan error, n)
+		for i := 0; i < n; i++ {
+			go func() {
+				s, err := d.Dial("lrcp", l.Addr().(*net.UDPAddr))
+				if err != nil {
+					errs <- err
+					return
+				}
+				sessions <- s
+			}()
+		}
+		ids := make(map[int]bool)
+		for i := 0; i < n; i++ {
+			select {
+			case err := <-errs:
+				t.Fatalf("unexpected dial error: %v", err)
+			case s := <-sessions:
+				defer s.Abort()
+				if ids[s.ID] {
+					t.Fatalf("duplicate session ID %d", s.ID)
+				}
+				ids[s.ID] = true
+			}
+		}
+
+		var registered int
+		d.sessionStore.Range(func(_, _ any) bool {
+			registered++
+			return true
+		})
+		if registered != n {
+			t.Fatalf("expected %d sessions registered with dialer, got %d", n, registered)
+		}
+	})
+	t.Run("multiplexed sessions share one socket", func(t *testing.T) {
+		l, err := Listen("lrcp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		go func() {
+			for {
+				s, err := l.AcceptLRCP()
+				if err != nil {
+					return
+				}
+				go io.Copy(s, s)
+			}
+		}()
+
+		const n = 20
+		d := &Dialer{LocalAddr: &net.UDPAddr{IP: net.ParseIP("127.0.0.1")}, Timeout: 5 * time.Second, Multiplex: true}
+		sessions := make([]*Session, n)
+		for i := range sessions {
+			s, err := d.Dial("lrcp", l.Addr().(*net.UDPAddr))
+			if err != nil {
+				t.Fatalf("unexpected dial error: %v", err)
+			}
+			sessions[i] = s
+		}
+		for i, s := range sessions {
+			if s.LocalAddr().String() != sessions[0].LocalAddr().String() {
+				t.Fatalf("session %d on [%s], expected shared socket [%s]", i, s.LocalAddr(), sessions[0].LocalAddr())
+			}
+			s.SetDeadline(time.Now().Add(5 * time.Second))
+			want := fmt.Sprintf("hello from %d\n", i)
+			if _, err := s.Write([]byte(want)); err != nil {
+				t.Fatalf("unexpected write error: %v", err)
+			}
+			got := make([]byte, len(want))
+			if _, err := io.ReadFull(s, got); err != nil {
+				t.Fatalf("unexpected read error: %v", err)
+			}
+			if string(got) != want {
+				t.Fatalf("session %d got %q, want %q", i, got, want)
+			}
+		}
+
+		// Closing one session leaves the others and the socket alone.
+		if err := sessions[0].Close(); err != nil {
+			t.Fatalf("unexpected close error: %v", err)
+		}
+		if _, err := sessions[1].Write([]byte("still here\n")); err != nil {
+			t.Fatalf("unexpected write error: %v", err)
+		}
+		got := make([]byte, len("still here\n"))
+		if _, err := io.ReadFull(sessions[1], got); err != nil {
+			t.Fatalf("unexpected read error after closing a sibling: %v", err)
+		}
+
+		if err := d.Close(); err != nil {
+			t.Fatalf("unexpected dialer close error: %v", err)
+		}
+		if _, err := sessions[1].Read(got); err != io.EOF {
+			t.Fatalf("expected io.EOF after dialer close, got %v", err)
+		}
+		if _, err := d.Dial("lrcp", l.Addr().(*net.UDPAddr)); !errors.Is(err, net.ErrClosed) {
+			t.Fatalf("expected net.ErrClosed dialing after close, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,130 @@
+package lrcp
+
+import "time"
+
+// Config tunes the timeouts and buffer sizes of the sessions created by a Listener or Dialer.
+// A nil *Config uses the defaults, as does any field left at its zero value:
+// each default is the package constant of the same name, except for KeepAlive
+// and the Listener's admission limits, which are off by default.
+type Config struct {
+	// RetransmissionTimeout is the retransmission timeout used until round trip
+	// times have been measured.
+	RetransmissionTimeout time.Duration
+	// MinRetransmissionTimeout and MaxRetransmissionTimeout bound the measured
+	// retransmission timeout, including backoff.
+	MinRetransmissionTimeout time.Duration
+	MaxRetransmissionTimeout time.Duration
+
+	// ReadTimeout is how long a session waits to hear from its peer before expiring.
+	ReadTimeout time.Duration
+
+	// ReceiveBufferSize is how many incoming messages are queued for a session
+	// before further messages are dropped.
+	ReceiveBufferSize int
+	// ReorderBufferSize is how many bytes beyond the contiguous stream a session
+	// holds onto while waiting for a gap to be filled.
+	ReorderBufferSize int
+	// ReceiveWindow is how many bytes a session accepts beyond what has been read.
+	// Further data is refused until Read makes room, so the peer's retransmissions wait on the reader.
+	ReceiveWindow int
+	// SendBufferSize is how many written bytes a session buffers until they're acked.
+	// Write blocks while the buffer is full.
+	SendBufferSize int
+
+	// KeepAlive enables keepalive probes after a session has heard nothing from its
+	// peer for that long, and KeepAliveProbes is how many may go unanswered before
+	// the session expires. Zero KeepAlive disables them. See the KeepAliveProbes constant.
+	KeepAlive       time.Duration
+	KeepAliveProbes int
+
+	// AckEvery and AckDelay control delayed acks: in-order data is acknowledged
+	// every AckEvery messages, or AckDelay after the first unacknowledged one.
+	// The default AckEvery of 1 acknowledges every data message immediately.
+	AckEvery int
+	AckDelay time.Duration
+
+	// NoDelay disables write coalescing for new sessions, and CoalesceDelay bounds
+	// how long a short message is held back while it's enabled. See Session.SetNoDelay.
+	NoDelay       bool
+	CoalesceDelay time.Duration
+
+	// AcceptBufferSize is how many new sessions a Listener queues for Accept
+	// before it starts ignoring connects. Unused by Dialer.
+	AcceptBufferSize int
+
+	// Admission limits on a Listener's new sessions; unused by Dialer.
+	// Connects over a limit are ignored, so peers retry them later.
+	// MaxSessions caps the number of open sessions, and MaxSessionsPerSource
+	// the number of open sessions from one IP address. Zero means no limit.
+	MaxSessions          int
+	MaxSessionsPerSource int
+	// ConnectRate limits new sessions per second from one IP address, allowing
+	// bursts of up to ConnectBurst (at least 1). Zero means no limit.
+	ConnectRate  float64
+	ConnectBurst int
+
+	// Hardened makes a Listener drop messages that are unlikely to come from a session's
+	// real peer, rather than act on them. Acks of more than has been sent are ignored
+	// rather than closing the session. Data starting beyond the receive window, which the
+	// session would refuse anyway, goes unacknowledged; that only saves the duplicate ack.
+	// Closes (including the closes sent in reply to messages for unknown sessions) are
+	// limited to CloseRate per second from one IP address, in bursts of up to CloseBurst.
+	// See the package documentation. Unused by Dialer.
+	Hardened   bool
+	CloseRate  float64
+	CloseBurst int
+}
+
+// withDefaults returns a copy of c with every zero field set to its default. c may be nil.
+func (c *Config) withDefaults() Config {
+	var config Config
+	if c != nil {
+		config = *c
+	}
+	if config.RetransmissionTimeout <= 0 {
+		config.RetransmissionTimeout = RetransmissionTimeout
+	}
+	if config.MinRetransmissionTimeout <= 0 {
+		config.MinRetransmissionTimeout = MinRetransmissionTimeout
+	}
+	if config.MaxRetransmissionTimeout <= 0 {
+		config.MaxRetransmissionTimeout = MaxRetransmissionTimeout
+	}
+	if config.ReadTimeout <= 0 {
+		config.ReadTimeout = ReadTimeout
+	}
+	if config.ReceiveBufferSize <= 0 {
+		config.ReceiveBufferSize = ReceiveBufferSize
+	}
+	if config.ReorderBufferSize <= 0 {
+		config.ReorderBufferSize = ReorderBufferSize
+	}
+	if config.ReceiveWindow <= 0 {
+		config.ReceiveWindow = ReceiveWindow
+	}
+	if config.SendBufferSize <= 0 {
+		config.SendBufferSize = SendBufferSize
+	}
+	if config.KeepAliveProbes <= 0 {
+		config.KeepAliveProbes = KeepAliveProbes
+	}
+	if config.AckEvery <= 0 {
+		config.AckEvery = AckEvery
+	}
+	if config.AckDelay <= 0 {
+		config.AckDelay = AckDelay
+	}
+	if config.CoalesceDelay <= 0 {
+		config.CoalesceDelay = CoalesceDelay
+	}
+	if config.CloseRate <= 0 {
+		config.CloseRate = CloseRate
+	}
+	if config.CloseBurst <= 0 {
+		config.CloseBurst = CloseBurst
+	}
+	if config.AcceptBufferSize <= 0 {
+		config.AcceptBufferSize = AcceptBufferSize
+	}
+	return config
+}
@@ -0,0 +1,52 @@
+package lrcp
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"lrcp/lrcp/lrcptest"
+)
+
+func TestConfigDefaults(t *testing.T) {
+	if got := (*Config)(nil).withDefaults(); got.ReadTimeout != ReadTimeout || got.AcceptBufferSize != AcceptBufferSize {
+		t.Fatalf("nil config didn't get defaults: %+v", got)
+	}
+	got := (&Config{ReadTimeout: time.Second}).withDefaults()
+	if got.ReadTimeout != time.Second {
+		t.Fatalf("explicit ReadTimeout overridden: %s", got.ReadTimeout)
+	}
+	if got.RetransmissionTimeout != RetransmissionTimeout || got.ReceiveBufferSize != ReceiveBufferSize {
+		t.Fatalf("zero fields didn't get defaults: %+v", got)
+	}
+}
+
+// TestConfigReadTimeout checks that a Listener's sessions expire after the configured ReadTimeout.
+func TestConfigReadTimeout(t *testing.T) {
+	serverConn, clientConn := lrcptest.Pipe()
+	l := NewListener(serverConn, &Config{ReadTimeout: 100 * time.Millisecond})
+	defer l.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	client, err := DialPacketConn(ctx, clientConn, serverConn.LocalAddr())
+	if err != nil {
+		t.Fatalf("unexpected dial error: %v", err)
+	}
+	defer client.Abort()
+
+	s, err := l.AcceptLRCP()
+	if err != nil {
+		t.Fatalf("unexpected accept error: %v", err)
+	}
+	// The client stays silent, so the server session should give up on it.
+	s.SetReadDeadline(time.Now().Add(5 * time.Second))
+	start := time.Now()
+	if _, err := s.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected io.EOF once the session expired, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("session took %s to expire", elapsed)
+	}
+}
@@ -0,0 +1,80 @@
+package lrcp
+
+import "sync"
+
+// Largest number of data bytes a single data message can carry, assuming
+// maximal session and position fields and no escaped slashes.
+// Used as the segment size for congestion control.
+const maxSegmentSize = maxMessageSize - len("/data/2147483647/2147483647//")
+
+// Initial size of a Session's congestion window, in bytes.
+// Similar to TCP's initial window of 10 segments (RFC 6928).
+const InitialCongestionWindow = 10 * maxSegmentSize
+
+// Upper bound on a Session's congestion window, in bytes.
+// LRCP has no way for a peer to advertise how much it's willing to buffer,
+// so there's no point in having more in flight than our own peer would hold onto.
+const MaxCongestionWindow = ReorderBufferSize
+
+// congestionWindow caps the number of unacknowledged bytes a Session may have in flight.
+// It follows TCP's approach (RFC 5681): slow start doubles the window each round trip
+// until it reaches ssthresh, then congestion avoidance grows it by one segment per round trip.
+// A lost segment, detected by a retransmission timeout or by duplicate acks (see dupAckThreshold),
+// halves the window (multiplicative decrease) and ends slow start.
+//
+// The window is grown by Session.readWorker as acks arrive and shrunk by Session.writeWorker
+// on losses, so it is safe for concurrent use.
+type congestionWindow struct {
+	mu sync.Mutex
+	// size is the current window, in bytes.
+	size int
+	// ssthresh is the slow start threshold, in bytes.
+	ssthresh int
+	// acked counts bytes acked since the window last grew during congestion avoidance.
+	acked int
+}
+
+func newCongestionWindow() *congestionWindow {
+	return &congestionWindow{
+		size:     InitialCongestionWindow,
+		ssthresh: MaxCongestionWindow,
+	}
+}
+
+// Size returns the current window size in bytes.
+func (w *congestionWindow) Size() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.size
+}
+
+// onAck grows the window after the peer acknowledges n new bytes.
+func (w *congestionWindow) onAck(n int) {
+	if n <= 0 {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.size < w.ssthresh {
+		// Slow start: grow by up to one segment per ack.
+		w.size += min(n, maxSegmentSize)
+	} else {
+		// Congestion avoidance: grow by one segment per window's worth of acked data.
+		w.acked += n
+		if w.acked >= w.size {
+			w.acked -= w.size
+			w.size += maxSegmentSize
+		}
+	}
+	w.size = min(w.size, MaxCongestionWindow)
+}
+
+// onTimeout shrinks the window after a loss (a retransmission timeout or fast retransmit)
+// with inFlight bytes unacknowledged.
+func (w *congestionWindow) onTimeout(inFlight int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.ssthresh = max(min(inFlight, w.size)/2, 2*maxSegmentSize)
+	w.size = w.ssthresh
+	w.acked = 0
+}
@@ -0,0 +1,50 @@
+package lrcp
+
+import "testing"
+
+func TestCongestionWindow(t *testing.T) {
+	w := newCongestionWindow()
+	if got := w.Size(); got != InitialCongestionWindow {
+		t.Fatalf("unexpected initial window: got %d, want %d", got, InitialCongestionWindow)
+	}
+
+	// Slow start: each ack grows the window by up to a segment.
+	w.onAck(maxSegmentSize)
+	if got, want := w.Size(), InitialCongestionWindow+maxSegmentSize; got != want {
+		t.Fatalf("unexpected window after slow start ack: got %d, want %d", got, want)
+	}
+	w.onAck(10 * maxSegmentSize)
+	if got, want := w.Size(), InitialCongestionWindow+2*maxSegmentSize; got != want {
+		t.Fatalf("slow start should grow by at most one segment per ack: got %d, want %d", got, want)
+	}
+
+	// Multiplicative decrease on timeout, then congestion avoidance.
+	inFlight := w.Size()
+	w.onTimeout(inFlight)
+	if got, want := w.Size(), inFlight/2; got != want {
+		t.Fatalf("unexpected window after timeout: got %d, want %d", got, want)
+	}
+	size := w.Size()
+	w.onAck(size - 1)
+	if got := w.Size(); got != size {
+		t.Fatalf("congestion avoidance should wait for a full window of acks: got %d, want %d", got, size)
+	}
+	w.onAck(1)
+	if got, want := w.Size(), size+maxSegmentSize; got != want {
+		t.Fatalf("unexpected window after a full window of acks: got %d, want %d", got, want)
+	}
+
+	// Never shrinks below two segments, never grows above the max.
+	for i := 0; i < 10; i++ {
+		w.onTimeout(w.Size())
+	}
+	if got, want := w.Size(), 2*maxSegmentSize; got != want {
+		t.Fatalf("unexpected minimum window: got %d, want %d", got, want)
+	}
+	for i := 0; i < 10000; i++ {
+		w.onAck(maxSegmentSize)
+	}
+	if got := w.Size(); got != MaxCongestionWindow {
+		t.Fatalf("unexpected maximum window: got %d, want %d", got, MaxCongestionWindow)
+	}
+}
@@ -0,0 +1,79 @@
+package lrcp
+
+import (
+	"sync"
+	"time"
+)
+
+// deadline implements the timer behind Session.SetReadDeadline and Session.SetWriteDeadline.
+// Blocking calls select on the channel returned by wait(), which is closed once the deadline passes.
+// Modeled on the deadline handling of net.Pipe.
+type deadline struct {
+	mu    sync.Mutex
+	timer *time.Timer
+	// expired is closed when the deadline passes. Replaced whenever the deadline is reset.
+	expired chan struct{}
+}
+
+func newDeadline() *deadline {
+	return &deadline{expired: make(chan struct{})}
+}
+
+// set updates the deadline. A zero value for t means blocking calls will not time out.
+// A time in the past expires the deadline immediately.
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// If the timer already fired (or is about to), expired may already be closed.
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.expired // Wait for the timer callback to finish closing it
+	}
+	d.timer = nil
+
+	// Swap in a fresh channel if the old one has been closed.
+	closed := isClosed(d.expired)
+	if t.IsZero() {
+		if closed {
+			d.expired = make(chan struct{})
+		}
+		return
+	}
+
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.expired = make(chan struct{})
+		}
+		expired := d.expired
+		d.timer = time.AfterFunc(dur, func() {
+			close(expired)
+		})
+		return
+	}
+
+	// Deadline is in the past.
+	if !closed {
+		close(d.expired)
+	}
+}
+
+// wait returns a channel that is closed when the deadline passes.
+func (d *deadline) wait() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.expired
+}
+
+// exceeded reports whether the deadline has already passed.
+func (d *deadline) exceeded() bool {
+	return isClosed(d.wait())
+}
+
+func isClosed(c chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
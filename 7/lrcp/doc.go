@@ -0,0 +1,56 @@
+// Package lrcp implements the Line Reversal Control Protocol (LRCP), a lightweight
+// reliable transport layered over UDP, as specified by https://protohackers.com/problem/7.
+//
+// The API mirrors that of a TCP server or client in package net:
+//
+//	l, err := lrcp.Listen("lrcp", laddr, nil)
+//	...
+//	for {
+//		conn, err := l.Accept()
+//		...
+//	}
+//
+// and
+//
+//	conn, err := lrcp.Dial("lrcp", nil, raddr)
+//
+// or, to configure the client side, via a Dialer:
+//
+//	d := &lrcp.Dialer{Timeout: 5 * time.Second}
+//	conn, err := d.Dial("lrcp", raddr)
+//
+// Listener implements net.Listener and Session implements net.Conn, so code written
+// against TCP connections (bufio.Scanner, net/textproto, etc.) works unchanged.
+//
+// Listen and Dial use UDP, but the transport only needs a net.PacketConn:
+// NewListener and DialPacketConn run LRCP over any packet connection, such as a
+// unixgram socket or the in-memory network in package lrcptest.
+//
+// On top of the protocol's basic requirements, sessions buffer out-of-order data,
+// cap data in flight with a congestion window, and adapt their retransmission timeout
+// to the measured round trip time.
+//
+// # Threat model
+//
+// LRCP has no authentication: a message belongs to a session if it comes from the
+// session's peer address and carries its ID. An attacker on the path between the peers
+// can read, inject into or close any session, and nothing here defends against that;
+// run an authenticated protocol such as TLS over the Session if it matters.
+//
+// An off-path attacker who can forge UDP source addresses can still inject messages,
+// but must guess the session ID as well as the peer's address and port. Dialer picks
+// IDs with crypto/rand, leaving one chance in 2^31 per guess. A Listener has to accept
+// whatever IDs its clients choose, so it's only as safe as its clients' IDs.
+// A successful forgery can insert data into the stream, or close the session.
+// Config.Hardened makes a Listener ignore acks of data it hasn't sent, which would
+// otherwise close the session, and limits the closes it acts on (or sends in reply to
+// unknown sessions) per source IP. That throttles guessing, since every guess at a given
+// peer's sessions carries that peer's address. The price is that a flood of forged closes
+// can make a real close get ignored, in which case the session expires after
+// Config.ReadTimeout. A hardened Listener also drops data starting beyond a session's
+// receive window without acking it; the session would refuse that data anyway, so this
+// only saves the duplicate ack, and does nothing to stop forged data within the window.
+//
+// Floods of connects from forged addresses are limited separately, by the admission
+// limits of Config.
+package lrcp
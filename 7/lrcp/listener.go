@@ -0,0 +1,301 @@
+package lrcp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// How many new sessions a Listener queues for Accept.
+// Spec: "Make sure you support at least 20 simultaneous sessions."
+// This gives some room for 20 clients to all connect at once while still
+// providing backpressure.
+const AcceptBufferSize = 20
+
+// How often a Listener logs rejected connects; see Listener.reject.
+const rejectLogInterval = time.Second
+
+// Refused because Listener.acceptCh is full.
+var errAcceptQueueFull = errors.New("accept queue full")
+
+// Default rate limit on closes per IP address for a hardened Listener (see Config.Hardened.)
+// A peer only closes each session once, so a handful is plenty for legitimate use,
+// while an attacker guessing session IDs gets a couple of guesses a second.
+const (
+	CloseRate  = 2
+	CloseBurst = 10
+)
+
+type Listener struct {
+	conn   net.PacketConn
+	config Config
+	// acceptCh syncronizes Accept() with the listen() goroutine.
+	acceptCh chan *Session
+	// sessionStore is a map of session keys to sessions.
+	sessionStore sync.Map
+	// admission enforces the session limits of config.
+	admission *admission
+	rejected  rejectStats
+	// Rejections are logged at most once per rejectLogInterval, since a flood of
+	// connects would otherwise flood the log. Only touched by listen().
+	rejectLoggedAt    time.Time
+	rejectsSuppressed int
+	// closes limits closes when config.Hardened is set. Only touched by listen().
+	closes *rateLimiter
+
+	// Context for closing the listener.
+	ctx    context.Context
+	cancel context.CancelFunc
+	// Eliminates a race condition on Close
+	closeLock sync.Mutex
+}
+
+// Listener implements net.Listener, so it can be used anywhere a TCP listener would be.
+var _ net.Listener = (*Listener)(nil)
+
+// Listen announces on the local address laddr.
+// `network` must be "lrcp" (IPv4 and IPv6), "lrcp4" (IPv4 only) or "lrcp6" (IPv6 only.)
+// If the IP field of laddr is nil or unspecified, Listen listens on all available addresses.
+// Sessions are tuned by config; nil uses the defaults.
+func Listen(network string, laddr *net.UDPAddr, config *Config) (*Listener, error) {
+	udpNet, err := udpNetwork(network)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP(udpNet, laddr)
+	if err != nil {
+		return nil, fmt.Errorf(`error listening on %s: %s`, laddr, err)
+	}
+	return NewListener(conn, config), nil
+}
+
+// NewListener returns a Listener serving LRCP over an existing packet connection,
+// such as a unixgram socket or an in-memory pipe in tests.
+// The Listener takes ownership of conn and closes it on Close.
+// Sessions are tuned by config; nil uses the defaults.
+func NewListener(conn net.PacketConn, config *Config) *Listener {
+	log.Printf(`listening on %s`, conn.LocalAddr())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	l := &Listener{
+		conn:   conn,
+		config: config.withDefaults(),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	l.acceptCh = make(chan *Session, l.config.AcceptBufferSize)
+	l.admission = newAdmission(l.config)
+	l.closes = newRateLimiter(l.config.CloseRate, l.config.CloseBurst)
+	go l.listen()
+
+	return l
+}
+
+// Addr returns the listener's local network address.
+func (l *Listener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+// Close stops the listener. Can be safely called multiple times.
+// Unblocks any pending Accept calls, closes every open session (notifying peers),
+// then stops the read loop and releases the underlying connection.
+func (l *Listener) Close() error {
+	l.closeLock.Lock()
+	defer l.closeLock.Unlock()
+
+	select {
+	case <-l.ctx.Done():
+		return nil
+	default:
+	}
+	l.cancel()
+	log.Printf(`Listener: closing`)
+	// Sessions still need the conn to send their close messages, so close it last.
+	l.sessionStore.Range(func(_, value any) bool {
+		value.(*Session).shutdown()
+		return true
+	})
+	return l.conn.Close()
+}
+
+// cleanup is a callback for sessions that have quit (for whatever reason).
+func (l *Listener) cleanup(session *Session) {
+	log.Printf(`Listener: Session[%s] has quit. Removing from session store.`, session.Key())
+	l.forget(session)
+}
+
+// forget removes session from the store and releases its admission slot.
+// Safe to call more than once, and never touches a newer session with the same key.
+func (l *Listener) forget(session *Session) {
+	if l.sessionStore.CompareAndDelete(session.Key(), session) {
+		l.admission.release(sourceKey(session.addr))
+	}
+}
+
+// reject counts and logs a refused connect.
+func (l *Listener) reject(addr net.Addr, id int, err error) {
+	switch err {
+	case errMaxSessions:
+		l.rejected.maxSessions.Add(1)
+	case errMaxSessionsPerSource:
+		l.rejected.maxSessionsPerSource.Add(1)
+	case errConnectRate:
+		l.rejected.connectRate.Add(1)
+	case errAcceptQueueFull:
+		l.rejected.acceptQueueFull.Add(1)
+	}
+	now := time.Now()
+	if now.Sub(l.rejectLoggedAt) < rejectLogInterval {
+		l.rejectsSuppressed++
+		return
+	}
+	log.Printf(`Listener: rejected connect for session [%s]: %v (%d similar messages suppressed)`, sessionKey(addr, id), err, l.rejectsSuppressed)
+	l.rejectLoggedAt = now
+	l.rejectsSuppressed = 0
+}
+
+// listen is the core read loop for all incoming packets, demux'ing them to their respective sessions
+// and creating new sessions as needed.
+func (l *Listener) listen() {
+	// Get a packet; parse a message (or don't)
+	// New session: Create if CONNECT, otherwise send CLOSE.
+	// Not a new session: send ACK and DATA to session over buffered channel (send via select; just drop if buffer full)
+
+	buf := make([]byte, maxMessageSize)
+	for {
+		// Read a packet
+		n, addr, err := l.conn.ReadFrom(buf)
+		select {
+		case <-l.ctx.Done():
+			log.Printf(`Listener: closed; exiting read loop`)
+			return
+		default:
+		}
+		if err != nil {
+			log.Printf(`Listener: error reading: %s`, err)
+			continue
+		}
+		rawMsg := buf[:n]
+		log.Printf(`Listener: got [%d] bytes from [%s]`, n, addr.String())
+
+		// Parse a message; pull from pool since we'd otherwise be allocating a lot of these.
+		parsedMsg, err := parseMessage(rawMsg)
+		if err != nil {
+			// Just drop invalid messages
+			log.Printf(`Listener: error parsing message: [%s]`, err)
+			continue
+		}
+
+		// Find or create a session (or send a close for a non-CONNECT to an unrecognized session)
+		// Sessions are supposedly guaranteed to be unique to IP addresses,
+		// but it's easy enough to prevent collisions by including the IP address and port in our key.
+		var session *Session
+		if parsedMsg.Type == `connect` {
+			if loadedSession, loaded := l.sessionStore.Load(sessionKey(addr, parsedMsg.Session)); loaded {
+				// Existing session; just ack the redundant connect.
+				session = loadedSession.(*Session)
+			} else {
+				source := sourceKey(addr)
+				if err := l.admission.admit(source, time.Now()); err != nil {
+					// Don't ack or close, so the peer can retry.
+					l.reject(addr, parsedMsg.Session, err)
+					continue
+				}
+				session = newSession(addr, parsedMsg.Session, l.conn, l.config, l.cleanup, false)
+				l.sessionStore.Store(session.Key(), session)
+				// Abort skips cleanup, so make sure the session is forgotten however it ends.
+				context.AfterFunc(session.ctx, func() { l.forget(session) })
+				// Send to accept channel. Tear down if we can't.
+				select {
+				case l.acceptCh <- session:
+					log.Printf(`Listener: accepted session [%s]`, session.Key())
+				default:
+					// Abort session and remove from store.
+					// Don't ack since we dropped. Don't *send* a CLOSE so peer can retry.
+					l.reject(addr, parsedMsg.Session, errAcceptQueueFull)
+					session.Abort()
+					l.forget(session)
+					continue
+				}
+			}
+			session.stats.received(n)
+			// Regardless, nothing more to do here but send an ACK. If this fails, they can always retry the CONNECT.
+			if err = session.sendAck(0); err != nil {
+				log.Printf(`Listener: error sending ack to [%s]: %s`, addr, err)
+			}
+			continue
+		} else {
+			// Not a connect. Try to load. Continue on failure.
+			loadedSession, loaded := l.sessionStore.Load(sessionKey(addr, parsedMsg.Session))
+			if !loaded {
+				// Rate limited when hardened, since the source may be forged to reflect these at someone.
+				if l.config.Hardened && !l.closes.allow(sourceKey(addr), time.Now()) {
+					l.rejected.closeRate.Add(1)
+					continue
+				}
+				sendClose(parsedMsg.Session, addr, l.conn)
+				continue
+			}
+			session = loadedSession.(*Session)
+			session.stats.received(n)
+		}
+		switch parsedMsg.Type {
+		case `connect`:
+			continue
+		case `close`:
+			// A forged close could tear down someone else's session, so limit how many a source gets.
+			if l.config.Hardened && !l.closes.allow(sourceKey(addr), time.Now()) {
+				l.rejected.closeRate.Add(1)
+				log.Printf(`Listener: close rate exceeded; ignoring close for session [%s]`, session.Key())
+				continue
+			}
+			// Close session and remove from store.
+			log.Printf(`Listener: peer disconnect; closing session [%s]`, session.Key())
+			session.shutdown()
+			sendClose(parsedMsg.Session, addr, l.conn)
+		case `ack`, `data`:
+			// Drop anything too far from what the session expects to come from its peer,
+			// rather than let the session ack it, or close on it.
+			if l.config.Hardened && !session.inWindow(parsedMsg) {
+				l.rejected.outOfWindow.Add(1)
+				log.Printf(`Listener: dropping out-of-window [%s] for session [%s]`, parsedMsg.Type, session.Key())
+				continue
+			}
+			// Send ACK and DATA to session.
+			// Don't acknowledge DATA yet, since we may drop packets here.
+			err = session.receive(parsedMsg)
+			if err != nil {
+				// Do nothing; just drop the packet.
+				log.Printf(`Session[%s].listenClient: dropped packet: %v`, session.Key(), err)
+			}
+		default:
+			log.Printf(`Listener: unexpected packet type [%s] for session [%s]`, parsedMsg.Type, session.Key())
+		}
+	}
+}
+
+// Accept blocks until a new Session is available, then returns it.
+// Implements net.Listener; see AcceptLRCP to get a *Session directly.
+func (l *Listener) Accept() (net.Conn, error) {
+	// Don't return a nil *Session as a non-nil net.Conn.
+	s, err := l.AcceptLRCP()
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// AcceptLRCP blocks until a new Session is available, then returns it.
+// Returns an error wrapping net.ErrClosed once the listener is closed.
+func (l *Listener) AcceptLRCP() (*Session, error) {
+	select {
+	case <-l.ctx.Done():
+		return nil, fmt.Errorf("listener closed: %w", net.ErrClosed)
+	case session := <-l.acceptCh:
+		return session, nil
+	}
+}
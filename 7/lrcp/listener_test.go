@@ -0,0 +1,106 @@
+package lrcp
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestListenerClose(t *testing.T) {
+	l, err := Listen("lrcp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := Dial("lrcp", nil, l.Addr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("unexpected dial error: %v", err)
+	}
+	defer client.Close()
+	server, err := l.AcceptLRCP()
+	if err != nil {
+		t.Fatalf("unexpected accept error: %v", err)
+	}
+
+	// A pending Accept should be unblocked by Close.
+	acceptErr := make(chan error, 1)
+	go func() {
+		_, err := l.Accept()
+		acceptErr <- err
+	}()
+
+	if err := l.Close(); err != nil {
+		t.Fatalf("unexpected close error: %v", err)
+	}
+	select {
+	case err := <-acceptErr:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Fatalf("expected net.ErrClosed from pending accept, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("pending accept wasn't unblocked by close")
+	}
+	if conn, err := l.Accept(); !errors.Is(err, net.ErrClosed) || conn != nil {
+		t.Fatalf("expected nil conn and net.ErrClosed from accept after close, got %v, %v", conn, err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatalf("unexpected error closing twice: %v", err)
+	}
+
+	// Both ends of the open session should see it closed.
+	for name, s := range map[string]*Session{"server": server, "client": client} {
+		s.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := s.Read(make([]byte, 1)); err != io.EOF {
+			t.Fatalf("expected EOF reading from %s session, got %v", name, err)
+		}
+	}
+}
+
+// TestListenerHardened checks that a hardened Listener drops implausible messages,
+// and rate limits closes.
+func TestListenerHardened(t *testing.T) {
+	peer := newPipePeer(t, &Config{Hardened: true, ReceiveWindow: 100, CloseRate: 0.1, CloseBurst: 1})
+	peer.connect(1234)
+
+	// An ack of unsent data would close an ordinary session, and data beyond
+	// the window would be acked; here both are ignored.
+	peer.send(`/ack/1234/50/`)
+	peer.send(`/data/1234/1000/x/`)
+	if msg := peer.expect(100 * time.Millisecond); msg != nil {
+		t.Fatalf("expected out-of-window messages to be dropped, got %+v", msg)
+	}
+	// The window ends where the session's own does: data at 100 is outside it, at 99 inside.
+	peer.send(`/data/1234/100/x/`)
+	if msg := peer.expect(100 * time.Millisecond); msg != nil {
+		t.Fatalf("expected data at the window's end to be dropped, got %+v", msg)
+	}
+	peer.send(`/data/1234/99/x/`)
+	if got := peer.expectAck(time.Second); got != 0 {
+		t.Fatalf("expected ack of 0 for out-of-order data inside the window, got %d", got)
+	}
+	peer.send(`/data/1234/0/hi/`)
+	if got := peer.expectAck(time.Second); got != 2 {
+		t.Fatalf("expected ack of 2 for in-window data, got %d", got)
+	}
+
+	// The close for an unknown session uses up the burst, so the next close is ignored.
+	peer.send(`/close/99/`)
+	if msg := peer.expect(time.Second); msg == nil || msg.Type != `close` || msg.Session != 99 {
+		t.Fatalf("expected close reply for unknown session, got %+v", msg)
+	}
+	peer.send(`/close/1234/`)
+	if msg := peer.expect(100 * time.Millisecond); msg != nil {
+		t.Fatalf("expected rate-limited close to be dropped, got %+v", msg)
+	}
+	peer.send(`/data/1234/2/!/`)
+	if got := peer.expectAck(time.Second); got != 3 {
+		t.Fatalf("expected session to survive a rate-limited close and ack 3, got %d", got)
+	}
+
+	stats := peer.l.Stats()
+	if stats.DroppedOutOfWindow != 3 || stats.DroppedCloses != 1 {
+		t.Fatalf("unexpected drop counts: %d out of window, %d closes", stats.DroppedOutOfWindow, stats.DroppedCloses)
+	}
+}
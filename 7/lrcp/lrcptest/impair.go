@@ -0,0 +1,182 @@
+// Package lrcptest provides utilities for testing LRCP over bad networks.
+//
+// Proxy sits between an LRCP client and server and mistreats the UDP
+// traffic passing through it according to Impairments. Every decision the
+// proxy makes (drop, duplicate, delay, reorder, corrupt) is drawn afresh for
+// each packet from a hash of Impairments.Seed, the direction, the packet's
+// contents and how many times those contents have passed that way before.
+// So for a given seed, a message meets the same fate in every run however
+// its sending is timed against other traffic, and a rerun that sends the
+// same messages replays the original exactly. The session ID is left out of
+// the hash, since dialers pick it at random. Bursts of loss (see
+// Impairments.BurstLoss) are the exception: they swallow whichever packets
+// follow the one that starts them.
+//
+// Network provides in-memory packet connections, for running LRCP over
+// lrcp.NewListener and lrcp.DialPacketConn without real sockets.
+package lrcptest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/fnv"
+	"time"
+)
+
+// Impairments configures how a Proxy mistreats packets.
+// Probabilities are in [0, 1]; the zero value forwards everything untouched.
+type Impairments struct {
+	// Seed for the hash that drives every decision.
+	Seed int64
+
+	// Loss is the probability that a packet is dropped.
+	Loss float64
+	// BurstLoss is the probability that a packet starts a burst of
+	// BurstLength consecutive drops.
+	BurstLoss   float64
+	BurstLength int
+
+	// Duplicate is the probability that a packet is delivered twice.
+	Duplicate float64
+
+	// Reorder is the probability that a packet is held back for an extra
+	// ReorderDelay, letting packets sent after it overtake it.
+	Reorder      float64
+	ReorderDelay time.Duration
+
+	// Delay is added to every packet, plus a uniform random jitter in [0, Jitter).
+	Delay  time.Duration
+	Jitter time.Duration
+
+	// Bandwidth caps throughput in bytes per second; 0 means unlimited.
+	// Packets queue behind each other while the link is busy.
+	Bandwidth int
+
+	// Corrupt is the probability that one byte between the first and last
+	// slash of a packet is flipped. The packet stays slash-delimited, so it
+	// exercises the parser rather than being rejected outright.
+	Corrupt float64
+}
+
+// fate is what happens to a single packet.
+type fate struct {
+	drop      bool
+	duplicate bool
+	reorder   bool
+	delay     time.Duration
+	corruptAt int // Index of the corrupted byte, or -1
+	corruptBy byte
+}
+
+// impairer decides packet fates for one direction of traffic.
+type impairer struct {
+	imp       Impairments
+	direction int64
+	// seen counts the packets decided so far, by hash of their contents.
+	seen      map[uint64]int
+	burstLeft int
+}
+
+func newImpairer(imp Impairments, direction int64) *impairer {
+	return &impairer{
+		imp: imp,
+		// Each direction draws differently, so the same message sent both
+		// ways needn't meet the same fate.
+		direction: direction,
+		seen:      make(map[uint64]int),
+	}
+}
+
+// draws is a splitmix64 stream of pseudo-random values, cheap enough to
+// start afresh for every packet.
+type draws uint64
+
+func (d *draws) next() uint64 {
+	*d += 0x9e3779b97f4a7c15
+	z := uint64(*d)
+	z = (z ^ z>>30) * 0xbf58476d1ce4e5b9
+	z = (z ^ z>>27) * 0x94d049bb133111eb
+	return z ^ z>>31
+}
+
+// float64 returns a value in [0, 1).
+func (d *draws) float64() float64 {
+	return float64(d.next()>>11) / (1 << 53)
+}
+
+// contentHash hashes p, leaving out the session ID if p looks like an LRCP message.
+func contentHash(p []byte) uint64 {
+	h := fnv.New64a()
+	if fields := bytes.SplitN(p, []byte("/"), 4); len(fields) == 4 {
+		// "", type, session, rest
+		h.Write(fields[1])
+		h.Write([]byte("/"))
+		h.Write(fields[3])
+	} else {
+		h.Write(p)
+	}
+	return h.Sum64()
+}
+
+// decide draws the fate of packet p.
+// Apart from bursts, the fate depends only on the seed, the direction, p's contents
+// (less its session ID) and how many times they've been seen before, not on when p
+// arrives relative to other packets.
+func (im *impairer) decide(p []byte) fate {
+	content := contentHash(p)
+	occurrence := im.seen[content]
+	im.seen[content]++
+
+	var key [32]byte
+	binary.LittleEndian.PutUint64(key[0:], uint64(im.imp.Seed))
+	binary.LittleEndian.PutUint64(key[8:], uint64(im.direction))
+	binary.LittleEndian.PutUint64(key[16:], content)
+	binary.LittleEndian.PutUint64(key[24:], uint64(occurrence))
+	h := fnv.New64a()
+	h.Write(key[:])
+	rng := draws(h.Sum64())
+
+	loss := rng.float64()
+	burst := rng.float64()
+	dup := rng.float64()
+	reorder := rng.float64()
+	jitter := rng.float64()
+	corrupt := rng.float64()
+	corruptAt := rng.float64()
+	corruptBy := byte(rng.next()%255) + 1 // Never 0, so the byte always changes
+
+	n := len(p)
+	f := fate{corruptAt: -1}
+	if im.burstLeft > 0 {
+		im.burstLeft--
+		f.drop = true
+	} else if burst < im.imp.BurstLoss {
+		im.burstLeft = im.imp.BurstLength - 1
+		f.drop = true
+	}
+	if loss < im.imp.Loss {
+		f.drop = true
+	}
+	if f.drop {
+		return f
+	}
+	f.duplicate = dup < im.imp.Duplicate
+	f.delay = im.imp.Delay + time.Duration(jitter*float64(im.imp.Jitter))
+	if reorder < im.imp.Reorder {
+		f.reorder = true
+		f.delay += im.imp.ReorderDelay
+	}
+	// Leave the leading and trailing slash alone.
+	if corrupt < im.imp.Corrupt && n > 2 {
+		f.corruptAt = 1 + int(corruptAt*float64(n-2))
+		f.corruptBy = corruptBy
+	}
+	return f
+}
+
+// apply corrupts p in place according to f.
+func (f fate) apply(p []byte) {
+	if f.corruptAt >= 0 {
+		p[f.corruptAt] ^= f.corruptBy
+	}
+}
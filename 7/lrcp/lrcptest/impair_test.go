@@ -0,0 +1,132 @@
+package lrcptest
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+var messy = Impairments{
+	Seed:         42,
+	Loss:         0.1,
+	BurstLoss:    0.05,
+	BurstLength:  3,
+	Duplicate:    0.1,
+	Reorder:      0.1,
+	ReorderDelay: 10 * time.Millisecond,
+	Delay:        5 * time.Millisecond,
+	Jitter:       5 * time.Millisecond,
+	Corrupt:      0.1,
+}
+
+// fates decides n sends of the same 100-byte packet.
+func fates(imp Impairments, n int) []fate {
+	im := newImpairer(imp, upstream)
+	p := bytes.Repeat([]byte("x"), 100)
+	fs := make([]fate, n)
+	for i := range fs {
+		fs[i] = im.decide(p)
+	}
+	return fs
+}
+
+// TestImpairerReplay checks that a seed pins the fate of each message, wherever
+// it falls in the sequence of packets.
+func TestImpairerReplay(t *testing.T) {
+	// Bursts drop whatever follows them, so leave them out.
+	imp := messy
+	imp.BurstLoss = 0
+	// decide sends message numbers in order from session, returning the fates
+	// by message number and occurrence.
+	decide := func(imp Impairments, session int, order []int) map[string]fate {
+		im := newImpairer(imp, upstream)
+		seen := make(map[int]int)
+		fs := make(map[string]fate)
+		for _, n := range order {
+			fs[fmt.Sprintf("%d#%d", n, seen[n])] = im.decide([]byte(fmt.Sprintf("/data/%d/%d/hello/", session, n)))
+			seen[n]++
+		}
+		return fs
+	}
+	// Each message is sent twice.
+	var inOrder []int
+	for n := 0; n < 500; n++ {
+		inOrder = append(inOrder, n, n)
+	}
+	a := decide(imp, 1234, inOrder)
+
+	// The same messages in another order, from another session, meet the same fates.
+	shuffled := rand.New(rand.NewSource(1)).Perm(500)
+	b := decide(imp, 5678, append(shuffled, shuffled...))
+	for key, f := range a {
+		if b[key] != f {
+			t.Fatalf("message %s: same seed gave different fates: %+v != %+v", key, f, b[key])
+		}
+	}
+
+	other := imp
+	other.Seed++
+	c := decide(other, 1234, inOrder)
+	same := true
+	for key, f := range a {
+		same = same && c[key] == f
+	}
+	if same {
+		t.Fatal("different seeds gave identical fates")
+	}
+}
+
+// TestImpairerKnobs checks that each knob has roughly the effect asked for.
+func TestImpairerKnobs(t *testing.T) {
+	const n = 10000
+	var dropped, dup, reordered, corrupted int
+	for _, f := range fates(messy, n) {
+		if f.drop {
+			dropped++
+			continue
+		}
+		if f.duplicate {
+			dup++
+		}
+		if f.reorder {
+			reordered++
+		}
+		if f.corruptAt >= 0 {
+			corrupted++
+		}
+		min := messy.Delay
+		max := messy.Delay + messy.Jitter + messy.ReorderDelay
+		if f.delay < min || f.delay >= max {
+			t.Fatalf("delay %v outside [%v, %v)", f.delay, min, max)
+		}
+	}
+	// Independent loss of 10% plus bursts of 3 starting 5% of the time.
+	if dropped < n/5 || dropped > n/3 {
+		t.Errorf("dropped %d of %d packets", dropped, n)
+	}
+	for name, got := range map[string]int{"duplicated": dup, "reordered": reordered, "corrupted": corrupted} {
+		delivered := n - dropped
+		if got < delivered/20 || got > delivered/5 {
+			t.Errorf("%s %d of %d delivered packets", name, got, delivered)
+		}
+	}
+}
+
+func TestCorruptKeepsFraming(t *testing.T) {
+	imp := Impairments{Seed: 1, Corrupt: 1}
+	im := newImpairer(imp, upstream)
+	msg := []byte("/data/1234/0/hello/")
+	for i := 0; i < 1000; i++ {
+		p := bytes.Clone(msg)
+		f := im.decide(p)
+		f.apply(p)
+		if bytes.Equal(p, msg) {
+			t.Fatalf("packet %d not corrupted: %+v", i, f)
+		}
+		if p[0] != '/' || p[len(p)-1] != '/' {
+			t.Fatalf("packet %d lost its framing: %q", i, p)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package lrcptest
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+	"time"
+)
+
+// packet is queued on a link until it is due for delivery.
+type packet struct {
+	due     time.Time
+	seq     uint64 // Breaks ties between packets due at the same time
+	data    []byte
+	deliver func([]byte)
+}
+
+type packetQueue []*packet
+
+func (q packetQueue) Len() int { return len(q) }
+func (q packetQueue) Less(i, j int) bool {
+	if q[i].due.Equal(q[j].due) {
+		return q[i].seq < q[j].seq
+	}
+	return q[i].due.Before(q[j].due)
+}
+func (q packetQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+func (q *packetQueue) Push(x any)   { *q = append(*q, x.(*packet)) }
+func (q *packetQueue) Pop() any {
+	old := *q
+	p := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	return p
+}
+
+// link carries packets in one direction, applying impairments and
+// delivering each packet once it is due.
+type link struct {
+	lock     sync.Mutex
+	im       *impairer
+	queue    packetQueue
+	seq      uint64
+	linkFree time.Time // When the link finishes transmitting queued packets
+	wake     chan struct{}
+	stats    Stats
+}
+
+func newLink(imp Impairments, direction int64) *link {
+	return &link{
+		im:   newImpairer(imp, direction),
+		wake: make(chan struct{}, 1),
+	}
+}
+
+// send impairs p and schedules it for delivery. p is copied.
+func (l *link) send(p []byte, deliver func([]byte)) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	f := l.im.decide(p)
+	if f.drop {
+		l.stats.Dropped++
+		return
+	}
+	data := make([]byte, len(p))
+	copy(data, p)
+	f.apply(data)
+	if f.corruptAt >= 0 {
+		l.stats.Corrupted++
+	}
+
+	// The packet can't start transmitting until the link is free.
+	now := time.Now()
+	sent := now
+	if bw := l.im.imp.Bandwidth; bw > 0 {
+		if l.linkFree.After(now) {
+			sent = l.linkFree
+		}
+		sent = sent.Add(time.Duration(len(data)) * time.Second / time.Duration(bw))
+		l.linkFree = sent
+	}
+	if f.reorder {
+		l.stats.Reordered++
+	}
+	l.push(sent.Add(f.delay), data, deliver)
+	if f.duplicate {
+		l.stats.Duplicated++
+		l.push(sent.Add(f.delay), data, deliver)
+	}
+
+	select {
+	case l.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (l *link) push(due time.Time, data []byte, deliver func([]byte)) {
+	l.seq++
+	heap.Push(&l.queue, &packet{due: due, seq: l.seq, data: data, deliver: deliver})
+}
+
+// run delivers packets as they come due until ctx is done.
+func (l *link) run(ctx context.Context) {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	for {
+		l.lock.Lock()
+		now := time.Now()
+		var ready []*packet
+		for l.queue.Len() > 0 && !l.queue[0].due.After(now) {
+			ready = append(ready, heap.Pop(&l.queue).(*packet))
+		}
+		wait := time.Hour
+		if l.queue.Len() > 0 {
+			wait = l.queue[0].due.Sub(now)
+		}
+		l.stats.Forwarded += len(ready)
+		l.lock.Unlock()
+
+		for _, p := range ready {
+			p.deliver(p.data)
+		}
+
+		// A stale tick from an earlier Reset only causes a spurious pass
+		// through the loop.
+		timer.Reset(wait)
+		select {
+		case <-ctx.Done():
+			return
+		case <-l.wake:
+		case <-timer.C:
+		}
+	}
+}
+
+// snapshot returns a copy of the link's counters.
+func (l *link) snapshot() Stats {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.stats
+}
@@ -0,0 +1,203 @@
+package lrcptest
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// packetQueueSize is how many packets an in-memory conn buffers before
+// dropping, like a socket's receive buffer.
+const packetQueueSize = 256
+
+// Addr is the address of an in-memory packet conn.
+type Addr string
+
+func (a Addr) Network() string { return "mem" }
+func (a Addr) String() string  { return string(a) }
+
+// Network is an in-memory packet network. Conns on the same Network can send
+// packets to each other by address, so LRCP can be tested without sockets.
+// Like UDP, packets to unknown addresses or full queues are silently dropped.
+type Network struct {
+	lock  sync.Mutex
+	conns map[Addr]*PacketConn
+}
+
+// NewNetwork returns an empty in-memory network.
+func NewNetwork() *Network {
+	return &Network{conns: make(map[Addr]*PacketConn)}
+}
+
+// ListenPacket returns a conn bound to addr.
+func (n *Network) ListenPacket(addr string) (*PacketConn, error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if _, ok := n.conns[Addr(addr)]; ok {
+		return nil, fmt.Errorf("listen %s: address already in use", addr)
+	}
+	c := &PacketConn{
+		network: n,
+		addr:    Addr(addr),
+		queue:   make(chan received, packetQueueSize),
+		closed:  make(chan struct{}),
+	}
+	c.deadline.ch = make(chan struct{})
+	n.conns[c.addr] = c
+	return c, nil
+}
+
+// Pipe returns two conns on a fresh network, addressed "a" and "b".
+func Pipe() (*PacketConn, *PacketConn) {
+	n := NewNetwork()
+	a, _ := n.ListenPacket("a")
+	b, _ := n.ListenPacket("b")
+	return a, b
+}
+
+func (n *Network) lookup(addr net.Addr) *PacketConn {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.conns[Addr(addr.String())]
+}
+
+func (n *Network) remove(c *PacketConn) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	delete(n.conns, c.addr)
+}
+
+type received struct {
+	data []byte
+	from Addr
+}
+
+// PacketConn is an in-memory net.PacketConn. Writes never block.
+type PacketConn struct {
+	network *Network
+	addr    Addr
+	queue   chan received
+
+	closeOnce sync.Once
+	closed    chan struct{}
+
+	// deadline.ch is closed when the read deadline passes, and replaced
+	// when the deadline is moved.
+	deadline struct {
+		sync.Mutex
+		ch    chan struct{}
+		timer *time.Timer
+	}
+}
+
+var _ net.PacketConn = (*PacketConn)(nil)
+
+// ReadFrom blocks until a packet arrives, the read deadline passes or c is closed.
+func (c *PacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	c.deadline.Lock()
+	expired := c.deadline.ch
+	c.deadline.Unlock()
+
+	select {
+	case <-c.closed:
+		return 0, nil, c.opError("read", net.ErrClosed)
+	default:
+	}
+	select {
+	case r := <-c.queue:
+		return copy(p, r.data), r.from, nil
+	case <-c.closed:
+		return 0, nil, c.opError("read", net.ErrClosed)
+	case <-expired:
+		return 0, nil, c.opError("read", os.ErrDeadlineExceeded)
+	}
+}
+
+// WriteTo queues a copy of p on the conn bound to addr, if any.
+func (c *PacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, c.opError("write", net.ErrClosed)
+	default:
+	}
+	if addr == nil {
+		return 0, c.opError("write", errors.New("missing address"))
+	}
+	peer := c.network.lookup(addr)
+	if peer == nil {
+		return len(p), nil
+	}
+	data := make([]byte, len(p))
+	copy(data, p)
+	select {
+	case peer.queue <- received{data: data, from: c.addr}:
+	default:
+	}
+	return len(p), nil
+}
+
+// Close unbinds the conn's address and unblocks pending reads.
+func (c *PacketConn) Close() error {
+	err := c.opError("close", net.ErrClosed)
+	c.closeOnce.Do(func() {
+		err = nil
+		close(c.closed)
+		c.network.remove(c)
+	})
+	return err
+}
+
+func (c *PacketConn) LocalAddr() net.Addr { return c.addr }
+
+func (c *PacketConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+// SetReadDeadline sets the deadline for current and future ReadFrom calls.
+// Same approach as net.Pipe: reads select on a channel that is closed when
+// the deadline passes, and replaced when the deadline is moved.
+func (c *PacketConn) SetReadDeadline(t time.Time) error {
+	c.deadline.Lock()
+	defer c.deadline.Unlock()
+
+	if c.deadline.timer != nil && !c.deadline.timer.Stop() {
+		<-c.deadline.ch // Wait for the timer callback to finish closing it
+	}
+	c.deadline.timer = nil
+
+	closed := isClosed(c.deadline.ch)
+	dur := time.Until(t)
+	if closed && (t.IsZero() || dur > 0) {
+		c.deadline.ch = make(chan struct{})
+	}
+	switch {
+	case t.IsZero():
+	case dur > 0:
+		ch := c.deadline.ch
+		c.deadline.timer = time.AfterFunc(dur, func() { close(ch) })
+	case !closed:
+		close(c.deadline.ch)
+	}
+	return nil
+}
+
+// SetWriteDeadline is a no-op, since writes never block.
+func (c *PacketConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+func isClosed(c chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *PacketConn) opError(op string, err error) error {
+	return &net.OpError{Op: op, Net: "mem", Addr: c.addr, Err: err}
+}
@@ -0,0 +1,137 @@
+package lrcptest
+
+import (
+	"context"
+	"log"
+	"net"
+	"sync"
+)
+
+const maxPacketSize = 65535
+
+// Directions, so that each link draws different fates.
+const (
+	upstream   = 0 // Client to server
+	downstream = 1 // Server to client
+)
+
+// Stats counts what a Proxy did to packets in one direction.
+type Stats struct {
+	Forwarded  int // Deliveries, including duplicates
+	Dropped    int
+	Duplicated int
+	Reordered  int
+	Corrupted  int
+}
+
+// Proxy forwards UDP packets between clients and a server through
+// impaired links. Each client gets its own socket towards the server,
+// so the server sees one address per client.
+type Proxy struct {
+	conn    *net.UDPConn
+	server  *net.UDPAddr
+	up      *link
+	down    *link
+	clients sync.Map // Client address string -> *net.UDPConn connected to server
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+// NewProxy listens on laddr and forwards to server, applying imp.
+// Pass a zero port in laddr and use Addr to pick a free port.
+func NewProxy(laddr, server *net.UDPAddr, imp Impairments) (*Proxy, error) {
+	conn, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &Proxy{
+		conn:   conn,
+		server: server,
+		up:     newLink(imp, upstream),
+		down:   newLink(imp, downstream),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	go p.up.run(ctx)
+	go p.down.run(ctx)
+	go p.listen()
+	return p, nil
+}
+
+// Addr returns the address clients should dial.
+func (p *Proxy) Addr() *net.UDPAddr {
+	return p.conn.LocalAddr().(*net.UDPAddr)
+}
+
+// Stats returns the counters for client-to-server and server-to-client traffic.
+func (p *Proxy) Stats() (up, down Stats) {
+	return p.up.snapshot(), p.down.snapshot()
+}
+
+// Close stops forwarding and closes all sockets. Queued packets are discarded.
+func (p *Proxy) Close() error {
+	p.cancel()
+	p.clients.Range(func(k, v any) bool {
+		v.(*net.UDPConn).Close()
+		return true
+	})
+	return p.conn.Close()
+}
+
+// listen reads packets from clients and sends them upstream.
+func (p *Proxy) listen() {
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, addr, err := p.conn.ReadFromUDP(buf)
+		if err != nil {
+			if p.ctx.Err() != nil {
+				return
+			}
+			log.Printf(`Proxy.listen: read error: %v`, err)
+			continue
+		}
+		serverConn, err := p.client(addr)
+		if err != nil {
+			log.Printf(`Proxy.listen: failed to dial [%v] for [%v]: %v`, p.server, addr, err)
+			continue
+		}
+		p.up.send(buf[:n], func(b []byte) {
+			// Delivery failures look like loss to LRCP, so ignore them.
+			serverConn.Write(b)
+		})
+	}
+}
+
+// client returns the server-side socket for addr, creating it on first use.
+// Only called from listen, so there's no race between Load and Store.
+func (p *Proxy) client(addr *net.UDPAddr) (*net.UDPConn, error) {
+	if c, ok := p.clients.Load(addr.String()); ok {
+		return c.(*net.UDPConn), nil
+	}
+	c, err := net.DialUDP("udp", nil, p.server)
+	if err != nil {
+		return nil, err
+	}
+	p.clients.Store(addr.String(), c)
+	go p.reverse(c, addr)
+	return c, nil
+}
+
+// reverse reads packets from the server for one client and sends them downstream.
+func (p *Proxy) reverse(serverConn *net.UDPConn, clientAddr *net.UDPAddr) {
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, err := serverConn.Read(buf)
+		if err != nil {
+			if p.ctx.Err() != nil {
+				return
+			}
+			log.Printf(`Proxy.reverse: read error from [%v]: %v`, p.server, err)
+			continue
+		}
+		p.down.send(buf[:n], func(b []byte) {
+			p.conn.WriteToUDP(b, clientAddr)
+		})
+	}
+}
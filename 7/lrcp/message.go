@@ -1,4 +1,4 @@
-package main
+package lrcp
 
 import (
 	"bytes"
@@ -17,12 +17,16 @@ import (
 // "Numeric field values must be smaller than 2147483648."
 const maxInt = 2147483647 // 2**31 - 1
 
+// MaxStreamLength is the most data that can be sent in either direction of a session,
+// since stream positions are numeric fields.
+const MaxStreamLength = maxInt
+
 // "LRCP messages must be smaller than 1000 bytes.
 // You might have to break up data into multiple data
 // messages in order to fit it below this limit."
 const maxMessageSize = 999
 
-type Msg struct {
+type message struct {
 	Type    string
 	Session int
 	// Note that Pos and Length could be int32, given our maxInt constraint.
@@ -33,7 +37,7 @@ type Msg struct {
 	Length int
 }
 
-func (m *Msg) Validate() error {
+func (m *message) validate() error {
 	if m.Session > maxInt {
 		return fmt.Errorf("session ID is too large (%d > %d)", m.Session, maxInt)
 	}
@@ -58,7 +62,7 @@ func (m *Msg) Validate() error {
 
 // encode will write the message to the provided buffer, returning the number of bytes written.
 // An error will be returned if the message is of an unknown type.
-func (m *Msg) encode(buf []byte) (int, error) {
+func (m *message) encode(buf []byte) (int, error) {
 	var data []byte
 	switch m.Type {
 	case "connect":
@@ -79,8 +83,8 @@ func (m *Msg) encode(buf []byte) (int, error) {
 // NOT the total size of the LRCP message.
 // The number of bytes that can be copied will depend on the lengths of the string representations
 // of the session ID and pos, and on the number of slashes that must be escaped.
-// pack does *not* handle validation! Call Validate() after calling pack.
-func (m *Msg) pack(data []byte) int {
+// pack does *not* handle validation! Call validate() after calling pack.
+func (m *message) pack(data []byte) int {
 	// /data/SESSION/POS/DATA/
 	// So 9 bytes for /data////, plus len(string(Session)), plus len(string(Pos))
 	// Subtracting from maxMsgSize, we get the max length of Data we can use.
@@ -96,7 +100,7 @@ func (m *Msg) pack(data []byte) int {
 
 	copySize := min(maxCopy, len(data)+slashes)
 
-	// In case we want to reuse an existing Msg. This Msg is likely reused via a pool.
+	// In case we want to reuse an existing message. This message is likely reused via a pool.
 	if m.Data == nil || len(m.Data) < copySize {
 		m.Data = make([]byte, copySize)
 	} else {
@@ -125,8 +129,8 @@ func (m *Msg) pack(data []byte) int {
 	return j
 }
 
-func parseMessage(bs []byte) (*Msg, error) {
-	msg := &Msg{}
+func parseMessage(bs []byte) (*message, error) {
+	msg := &message{}
 	if len(bs) == 0 {
 		return nil, errors.New("empty message")
 	}
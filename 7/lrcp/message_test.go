@@ -1,4 +1,4 @@
-package main
+package lrcp
 
 import (
 	"bytes"
@@ -236,7 +236,7 @@ func TestParseMessage(t *testing.T) {
 	cases := []struct {
 		name    string
 		in      []byte
-		want    *Msg
+		want    *message
 		wantErr bool
 	}{
 		{
@@ -272,31 +272,31 @@ func TestParseMessage(t *testing.T) {
 		{
 			name:    "parse connect",
 			in:      []byte(`/connect/1234/`),
-			want:    &Msg{Type: "connect", Session: 1234},
+			want:    &message{Type: "connect", Session: 1234},
 			wantErr: false,
 		},
 		{
 			name:    "parse ack",
 			in:      []byte(`/ack/1234/10/`),
-			want:    &Msg{Type: "ack", Session: 1234, Length: 10},
+			want:    &message{Type: "ack", Session: 1234, Length: 10},
 			wantErr: false,
 		},
 		{
 			name:    "parse close",
 			in:      []byte(`/close/1234/`),
-			want:    &Msg{Type: "close", Session: 1234},
+			want:    &message{Type: "close", Session: 1234},
 			wantErr: false,
 		},
 		{
 			name:    "parse data with single byte",
 			in:      []byte(`/data/1234/10/a/`),
-			want:    &Msg{Type: "data", Session: 1234, Pos: 10, Data: []byte(`a`)},
+			want:    &message{Type: "data", Session: 1234, Pos: 10, Data: []byte(`a`)},
 			wantErr: false,
 		},
 		{
 			name:    "parse data",
 			in:      []byte(`/data/1234/10/abc/`),
-			want:    &Msg{Type: "data", Session: 1234, Pos: 10, Data: []byte(`abc`)},
+			want:    &message{Type: "data", Session: 1234, Pos: 10, Data: []byte(`abc`)},
 			wantErr: false,
 		},
 	}
@@ -338,13 +338,13 @@ func TestParseMessage(t *testing.T) {
 func TestMessageValidate(t *testing.T) {
 	cases := []struct {
 		name    string
-		msg     *Msg
+		msg     *message
 		wantErr bool
 	}{
 		{
 			name: "error when data limit exceeded",
 			// maxInt-2 to maxInt+1
-			msg: &Msg{
+			msg: &message{
 				Type:    "data",
 				Session: 1234,
 				Pos:     maxInt - 2,
@@ -355,7 +355,7 @@ func TestMessageValidate(t *testing.T) {
 		},
 		{
 			name: "error when data Pos too large",
-			msg: &Msg{
+			msg: &message{
 				Type:    "data",
 				Session: 1234,
 				Pos:     maxInt + 1,
@@ -366,7 +366,7 @@ func TestMessageValidate(t *testing.T) {
 		},
 		{
 			name: "error when ack Length too large",
-			msg: &Msg{
+			msg: &message{
 				Type:    "ack",
 				Session: 1234,
 				Pos:     0,
@@ -378,7 +378,7 @@ func TestMessageValidate(t *testing.T) {
 	}
 	for _, c := range cases {
 		t.Run(c.name, func(t *testing.T) {
-			err := c.msg.Validate()
+			err := c.msg.validate()
 			if c.wantErr {
 				if err == nil {
 					t.Fatalf("expected error, got nil")
@@ -395,14 +395,14 @@ func TestMessageValidate(t *testing.T) {
 func TestEncode(t *testing.T) {
 	cases := []struct {
 		Description string
-		Msg         Msg
+		Msg         message
 		Data        []byte
 		Want        []byte
 		WantError   bool
 	}{
 		{
 			Description: "connect",
-			Msg: Msg{
+			Msg: message{
 				Type:    "connect",
 				Session: 1234,
 			},
@@ -410,7 +410,7 @@ func TestEncode(t *testing.T) {
 		},
 		{
 			Description: "ack",
-			Msg: Msg{
+			Msg: message{
 				Type:    "ack",
 				Session: 1234,
 				Length:  0,
@@ -419,7 +419,7 @@ func TestEncode(t *testing.T) {
 		},
 		{
 			Description: "data",
-			Msg: Msg{
+			Msg: message{
 				Type:    "data",
 				Session: 1234,
 				Pos:     0,
@@ -429,7 +429,7 @@ func TestEncode(t *testing.T) {
 		},
 		{
 			Description: "Errors on unknown type",
-			Msg: Msg{
+			Msg: message{
 				Type: "unknown",
 			},
 			WantError: true,
@@ -525,7 +525,7 @@ func TestPack(t *testing.T) {
 	}
 	for _, c := range cases {
 		t.Run(c.name, func(t *testing.T) {
-			m := Msg{Session: c.session, Pos: c.pos}
+			m := message{Session: c.session, Pos: c.pos}
 			n := m.pack(c.data)
 			if !bytes.Equal(m.Data, c.wantData) {
 				t.Fatalf("unexpected data: got %v, want %v", m.Data, c.wantData)
@@ -0,0 +1,50 @@
+package lrcp
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+)
+
+// udpNetwork maps an LRCP network name to the UDP network it runs over:
+// "lrcp" (IPv4 or IPv6), "lrcp4" (IPv4 only) or "lrcp6" (IPv6 only.)
+func udpNetwork(network string) (string, error) {
+	switch network {
+	case "lrcp":
+		return "udp", nil
+	case "lrcp4":
+		return "udp4", nil
+	case "lrcp6":
+		return "udp6", nil
+	default:
+		return "", net.UnknownNetworkError(network)
+	}
+}
+
+// sessionKey returns the key identifying session id from peer addr.
+// Sessions are supposedly guaranteed to be unique to IP addresses,
+// but it's easy enough to prevent collisions by including the IP address and port in our key.
+func sessionKey(addr net.Addr, id int) string {
+	return fmt.Sprintf("%s-%d", addrKey(addr), id)
+}
+
+// addrKey returns a string identifying addr, so that the same peer always produces the same key.
+// UDP addresses are normalized: IPv4-mapped IPv6 addresses (as seen on a dual-stack socket)
+// are unmapped, and IPv6 zones are kept so that link-local peers on different interfaces
+// stay distinct. Other address types are identified by their string form.
+func addrKey(addr net.Addr) string {
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		addrPort := udpAddr.AddrPort()
+		return netip.AddrPortFrom(addrPort.Addr().Unmap(), addrPort.Port()).String()
+	}
+	return fmt.Sprint(addr)
+}
+
+// sourceKey returns a string identifying the host behind addr, for per-source limits.
+// For UDP that's the (unmapped) IP address, so every port on a host counts as one source.
+func sourceKey(addr net.Addr) string {
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		return udpAddr.AddrPort().Addr().Unmap().String()
+	}
+	return addrKey(addr)
+}
@@ -0,0 +1,109 @@
+package lrcp
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSessionKey(t *testing.T) {
+	udp := func(s string) *net.UDPAddr {
+		addr, err := net.ResolveUDPAddr("udp", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return addr
+	}
+	cases := []struct {
+		name string
+		a, b *net.UDPAddr
+		same bool
+	}{
+		{
+			name: "IPv4-mapped IPv6 matches IPv4",
+			a:    udp("127.0.0.1:1234"),
+			b:    &net.UDPAddr{IP: net.ParseIP("::ffff:127.0.0.1"), Port: 1234},
+			same: true,
+		},
+		{
+			name: "4-byte and 16-byte IPv4 match",
+			a:    &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1).To4(), Port: 1234},
+			b:    &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1).To16(), Port: 1234},
+			same: true,
+		},
+		{
+			name: "IPv6 zones are distinct",
+			a:    udp("[fe80::1%eth0]:1234"),
+			b:    udp("[fe80::1%eth1]:1234"),
+			same: false,
+		},
+		{
+			name: "IPv6 with and without zone are distinct",
+			a:    udp("[fe80::1%eth0]:1234"),
+			b:    udp("[fe80::1]:1234"),
+			same: false,
+		},
+		{
+			name: "ports are distinct",
+			a:    udp("[::1]:1234"),
+			b:    udp("[::1]:1235"),
+			same: false,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			a, b := sessionKey(c.a, 42), sessionKey(c.b, 42)
+			if (a == b) != c.same {
+				t.Fatalf("unexpected keys: %s, %s (expected same: %v)", a, b, c.same)
+			}
+		})
+	}
+}
+
+func TestNetworks(t *testing.T) {
+	if _, err := Listen("udp", &net.UDPAddr{IP: net.IPv6loopback}, nil); err == nil {
+		t.Fatalf("expected error listening on non-LRCP network")
+	}
+
+	l, err := Listen("lrcp6", &net.UDPAddr{IP: net.IPv6loopback}, nil)
+	if err != nil {
+		t.Skipf("IPv6 loopback unavailable: %v", err)
+	}
+	defer l.Close()
+	raddr := l.Addr().(*net.UDPAddr)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := DialContext(ctx, "lrcp4", nil, raddr); err == nil {
+		t.Fatalf("expected error dialing IPv6 address over lrcp4")
+	}
+
+	for _, network := range []string{"lrcp6", "lrcp"} {
+		t.Run(network, func(t *testing.T) {
+			client, err := DialContext(ctx, network, nil, raddr)
+			if err != nil {
+				t.Fatalf("unexpected dial error: %v", err)
+			}
+			server, err := l.AcceptLRCP()
+			if err != nil {
+				t.Fatalf("unexpected accept error: %v", err)
+			}
+			if _, err := client.Write([]byte("hello")); err != nil {
+				t.Fatalf("unexpected write error: %v", err)
+			}
+			client.Close()
+
+			server.SetReadDeadline(time.Now().Add(time.Second))
+			got, err := io.ReadAll(server)
+			if err != nil {
+				t.Fatalf("unexpected read error: %v", err)
+			}
+			if !bytes.Equal(got, []byte("hello")) {
+				t.Fatalf(`unexpected data: got "%s"`, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,80 @@
+package lrcp
+
+import (
+	"context"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"lrcp/lrcp/lrcptest"
+)
+
+// TestPacketConns runs a session over packet connections other than UDP.
+func TestPacketConns(t *testing.T) {
+	cases := []struct {
+		name  string
+		conns func(t *testing.T) (server, client net.PacketConn)
+	}{
+		{
+			name: "in-memory pipe",
+			conns: func(t *testing.T) (net.PacketConn, net.PacketConn) {
+				server, client := lrcptest.Pipe()
+				return server, client
+			},
+		},
+		{
+			name: "unixgram",
+			conns: func(t *testing.T) (net.PacketConn, net.PacketConn) {
+				dir := t.TempDir()
+				server, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: filepath.Join(dir, "server"), Net: "unixgram"})
+				if err != nil {
+					t.Skipf("unixgram unavailable: %v", err)
+				}
+				client, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: filepath.Join(dir, "client"), Net: "unixgram"})
+				if err != nil {
+					server.Close()
+					t.Skipf("unixgram unavailable: %v", err)
+				}
+				return server, client
+			},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			serverConn, clientConn := c.conns(t)
+			l := NewListener(serverConn, nil)
+			defer l.Close()
+
+			go func() {
+				s, err := l.AcceptLRCP()
+				if err != nil {
+					return
+				}
+				io.Copy(s, s)
+			}()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			client, err := DialPacketConn(ctx, clientConn, serverConn.LocalAddr())
+			if err != nil {
+				t.Fatalf("unexpected dial error: %v", err)
+			}
+			defer client.Abort()
+			client.SetDeadline(time.Now().Add(5 * time.Second))
+
+			want := "hello/world\\\n"
+			if _, err := client.Write([]byte(want)); err != nil {
+				t.Fatalf("unexpected write error: %v", err)
+			}
+			got := make([]byte, len(want))
+			if _, err := io.ReadFull(client, got); err != nil {
+				t.Fatalf("unexpected read error: %v", err)
+			}
+			if string(got) != want {
+				t.Fatalf("unexpected echo: got %q, want %q", got, want)
+			}
+		})
+	}
+}
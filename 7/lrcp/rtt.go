@@ -0,0 +1,126 @@
+package lrcp
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock granularity used when computing the retransmission timeout (the G of RFC 6298.)
+const clockGranularity = time.Millisecond
+
+// rttEstimator measures round trip times from data and ack pairs and computes
+// a retransmission timeout (RTO) from them, following RFC 6298.
+//
+// Only one sample is timed at a time, and only for newly sent data: by Karn's algorithm,
+// an ack for retransmitted data is ambiguous, so any sample in progress is discarded when
+// the retransmission timer fires. Each consecutive timeout doubles the RTO until the peer
+// acks something new.
+//
+// Samples are started by Session.writeWorker and completed by Session.readWorker,
+// so it is safe for concurrent use.
+type rttEstimator struct {
+	mu sync.Mutex
+	// srtt and rttvar are the smoothed round trip time and its variance. Zero until the first sample.
+	srtt   time.Duration
+	rttvar time.Duration
+	// rto is the retransmission timeout before backoff is applied.
+	rto time.Duration
+	// backoff counts consecutive retransmission timeouts.
+	backoff int
+	// minRTO and maxRTO bound rto, including backoff.
+	minRTO time.Duration
+	maxRTO time.Duration
+
+	// timedEnd is the stream length whose ack completes the sample in progress, or 0 if there is none.
+	timedEnd int
+	// timedAt is when the timed data was sent.
+	timedAt time.Time
+}
+
+// newRTTEstimator returns an estimator using the retransmission timeouts from config.
+func newRTTEstimator(config Config) *rttEstimator {
+	return &rttEstimator{
+		rto:    config.RetransmissionTimeout,
+		minRTO: config.MinRetransmissionTimeout,
+		maxRTO: config.MaxRetransmissionTimeout,
+	}
+}
+
+// RTO returns the current retransmission timeout, including any backoff.
+func (e *rttEstimator) RTO() time.Duration {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	rto := e.rto
+	for i := 0; i < e.backoff && rto < e.maxRTO; i++ {
+		rto *= 2
+	}
+	return min(rto, e.maxRTO)
+}
+
+// SRTT returns the smoothed round trip time, or 0 if no samples have been taken yet.
+func (e *rttEstimator) SRTT() time.Duration {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.srtt
+}
+
+// onSend notes that new data ending at stream length end was just sent.
+// Starts timing it unless a sample is already in progress.
+func (e *rttEstimator) onSend(end int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.timedEnd > 0 {
+		return
+	}
+	e.timedEnd = end
+	e.timedAt = time.Now()
+}
+
+// onAck notes that the peer has acked new data up to stream length length.
+// Completes the sample in progress if it covers the timed data, and clears any backoff.
+func (e *rttEstimator) onAck(length int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.backoff = 0
+	if e.timedEnd == 0 || length < e.timedEnd {
+		return
+	}
+	e.sample(time.Since(e.timedAt))
+	e.timedEnd = 0
+}
+
+// onTimeout notes that the retransmission timer fired. Backs off the RTO and
+// discards any sample in progress, since the timed data is about to be resent.
+func (e *rttEstimator) onTimeout() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.backoff++
+	e.timedEnd = 0
+}
+
+// onRetransmit notes that unacknowledged data is being resent without a timeout.
+// Discards any sample in progress, since an ack of resent data is ambiguous (Karn's algorithm.)
+func (e *rttEstimator) onRetransmit() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.timedEnd = 0
+}
+
+// sample updates srtt, rttvar and rto with a new measurement r.
+// Caller must hold mu.
+func (e *rttEstimator) sample(r time.Duration) {
+	if e.srtt == 0 {
+		// First measurement.
+		e.srtt = r
+		e.rttvar = r / 2
+	} else {
+		diff := e.srtt - r
+		if diff < 0 {
+			diff = -diff
+		}
+		e.rttvar = (3*e.rttvar + diff) / 4
+		e.srtt = (7*e.srtt + r) / 8
+	}
+	e.rto = e.srtt + max(clockGranularity, 4*e.rttvar)
+	e.rto = min(max(e.rto, e.minRTO), e.maxRTO)
+}
@@ -0,0 +1,53 @@
+package lrcp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRTTEstimator(t *testing.T) {
+	e := newRTTEstimator((*Config)(nil).withDefaults())
+	if got := e.RTO(); got != RetransmissionTimeout {
+		t.Fatalf("unexpected initial RTO: got %s, want %s", got, RetransmissionTimeout)
+	}
+
+	// First sample: SRTT = R, RTTVAR = R/2, RTO = SRTT + 4*RTTVAR
+	e.sample(100 * time.Millisecond)
+	if got, want := e.RTO(), 300*time.Millisecond; got != want {
+		t.Fatalf("unexpected RTO after first sample: got %s, want %s", got, want)
+	}
+	// Second sample: RTTVAR = 3/4*50 + 1/4*|100-200| = 62.5, SRTT = 7/8*100 + 1/8*200 = 112.5
+	e.sample(200 * time.Millisecond)
+	if got, want := e.RTO(), 362500*time.Microsecond; got != want {
+		t.Fatalf("unexpected RTO after second sample: got %s, want %s", got, want)
+	}
+	if got, want := e.SRTT(), 112500*time.Microsecond; got != want {
+		t.Fatalf("unexpected SRTT after second sample: got %s, want %s", got, want)
+	}
+
+	// Timeouts back off exponentially, up to the max, and discard the sample in progress.
+	e.onSend(10)
+	e.onTimeout()
+	if got, want := e.RTO(), 725*time.Millisecond; got != want {
+		t.Fatalf("unexpected RTO after timeout: got %s, want %s", got, want)
+	}
+	for i := 0; i < 20; i++ {
+		e.onTimeout()
+	}
+	if got := e.RTO(); got != MaxRetransmissionTimeout {
+		t.Fatalf("unexpected RTO after many timeouts: got %s, want %s", got, MaxRetransmissionTimeout)
+	}
+	// An ack clears the backoff, but doesn't produce a sample for retransmitted data.
+	e.onAck(10)
+	if got, want := e.RTO(), 362500*time.Microsecond; got != want {
+		t.Fatalf("unexpected RTO after ack: got %s, want %s", got, want)
+	}
+
+	// Never drops below the minimum.
+	for i := 0; i < 100; i++ {
+		e.sample(time.Microsecond)
+	}
+	if got := e.RTO(); got != MinRetransmissionTimeout {
+		t.Fatalf("unexpected RTO after fast samples: got %s, want %s", got, MinRetransmissionTimeout)
+	}
+}
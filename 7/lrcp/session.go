@@ -0,0 +1,1164 @@
+package lrcp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The constants below are the defaults for the Config fields of the same name.
+
+// How long to wait before retransmitting unacknowledged data messages, until
+// round trip times have been measured (see rttEstimator.)
+// "retransmission timeout: the time to wait before retransmitting a message.
+// Suggested default value: 3 seconds."
+const RetransmissionTimeout = 500 * time.Millisecond
+
+// Bounds on the measured retransmission timeout. RFC 6298 suggests a minimum of 1 second,
+// which is far too slow on a local network; we go much lower and accept the occasional
+// spurious retransmission.
+const (
+	MinRetransmissionTimeout = 50 * time.Millisecond
+	MaxRetransmissionTimeout = 10 * time.Second
+)
+
+// How long to wait for a new message before timing out.
+// "session expiry timeout: the time to wait before accepting that a peer has disappeared,
+// in the event that no responses are being received. Suggested default value: 60 seconds."
+const ReadTimeout = 60 * time.Second
+
+// Delayed acks: a session acknowledges every AckEvery-th in-order data message, or
+// AckDelay after the first unacknowledged one, whichever comes first. Out-of-order and
+// duplicate data are always acknowledged immediately, so that the peer learns about
+// gaps without waiting. AckEvery of 1 acknowledges every data message.
+// AckDelay must stay well below MinRetransmissionTimeout, since the peer's
+// retransmission timer keeps running while an ack is held.
+const (
+	AckEvery = 1
+	AckDelay = 10 * time.Millisecond
+)
+
+// Write coalescing (Nagle's algorithm): while earlier data is unacknowledged, a session
+// holds back a data message shorter than maxSegmentSize so that later small writes can
+// be sent along with it, for up to CoalesceDelay. See Session.SetNoDelay.
+// Bounding the hold keeps coalescing from stalling against a peer's delayed acks.
+const CoalesceDelay = 5 * time.Millisecond
+
+// Number of duplicate acks that a session takes as a sign that the segment at the acked
+// length was lost. The peer acks its current length for every message it can't append,
+// so once this many arrive, the segment is resent straight away (fast retransmit, as in
+// RFC 5681) rather than waiting for the retransmission timer to rewind the whole window.
+const dupAckThreshold = 3
+
+// Keepalives, when enabled by Config.KeepAlive: a session that hears nothing from its peer
+// for that long sends a probe, and repeats every KeepAlive. A probe is an empty data message
+// at the length the peer has acked, which any LRCP peer must answer with an ack, so the
+// peer needn't have keepalives on itself. The probe also refreshes the peer's ReadTimeout.
+// So an idle but healthy session never expires, while one whose peer has gone away expires
+// once KeepAliveProbes probes in a row go unanswered, or after ReadTimeout, whichever comes first.
+const KeepAliveProbes = 3
+
+// How long Session.Close waits for the peer to acknowledge everything written before
+// giving up and closing anyway. See Session.SetLinger.
+const DefaultLinger = 10 * time.Second
+
+// Size of Session's receive buffer. Tuned to the rates at which Listener.listen
+// can process incoming packets and Session.readWorker can process a message.
+// Running TestBadLink with only 1% failure rate (near-full throughput):
+// 1 => ~8s
+// 16 => ~0.5-1.5s
+// At 25% failure:
+// 1 => ~16s
+// 16 => ~7s
+// I didn't test super rigorously yet, but it seemed to fall off around there on my machine.
+const ReceiveBufferSize = 16
+
+// Maximum number of bytes beyond the current contiguous length that a Session will
+// hold onto while waiting for a gap to be filled. Data arriving further ahead than
+// this is dropped, and the peer will retransmit it once the gap has been filled.
+// Roughly 64 full-size data messages.
+const ReorderBufferSize = 64 * 1024
+
+// Maximum number of bytes a Session will receive beyond what the application has read.
+// Data past the window is refused and acks report only what was accepted, so a peer
+// writing faster than we read ends up retransmitting into the window as it reopens,
+// rather than filling our memory.
+const ReceiveWindow = 256 * 1024
+
+// Maximum number of written bytes a Session buffers until the peer acknowledges them.
+// Once it's full, Session.Write blocks until acks make room, as a TCP socket would.
+const SendBufferSize = 256 * 1024
+
+type Session struct {
+	// Synchronizes Session.Read and Session.readWorker
+	readLock sync.Mutex
+	// Synchronizes Session.Write and Session.writeWorker
+	writeLock sync.Mutex
+	// Serializes Session.Write calls, so that a write blocked on a full send buffer
+	// isn't interleaved with another.
+	writerLock sync.Mutex
+	// Eliminates a race condition on Close
+	closeLock sync.Mutex
+
+	// The peer's address.
+	addr net.Addr
+	// The session's unique ID used in LRCP messages (e.g. SESSION in /data/SESSION/POS/DATA/).
+	ID int
+
+	// Timeouts and buffer sizes, with defaults filled in.
+	config Config
+
+	// The packet connection to send messages on; usually UDP.
+	// Incoming messages are de-muxed by the listener.
+	conn net.PacketConn
+
+	// Context for closing the session.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// cleanup is a callback function for the session to call when closed.
+	cleanup func(s *Session)
+
+	// receiveCh is a channel to receive messages from the listener
+	receiveCh chan *message
+	// readCh signals that data is available for reading.
+	// This channel should be buffered to allow .Read and .readWorker to communicate without blocking.
+	readCh chan bool
+	// writeCh signals that data is available for sending.
+	// Like readCh, this is 1-buffered so that Write never blocks on writeWorker.
+	writeCh chan bool
+	// fastRetransmitCh signals writeWorker to resend the segment at lastAck (see dupAckThreshold.)
+	// Also 1-buffered, so readWorker never blocks on writeWorker.
+	fastRetransmitCh chan bool
+
+	// readBuffer is the session's received data that hasn't yet been discarded after being read.
+	// readBuffer[0] is at stream position readBase, so the contiguous length received is
+	// readBase + len(readBuffer).
+	readBuffer []byte
+	readBase   int
+	// reorderBuffer holds data received ahead of a gap in readBuffer.
+	// Segments are sorted by position and never overlap or touch.
+	// Guarded by readLock.
+	reorderBuffer []segment
+	// readIndex is the stream position of the next byte to read from the session data. Used to implement io.Reader.
+	readIndex int
+	// lastAck is the length that was last acknowledged by the peer.
+	// atomic.Int32 used to allow lock-free access and modification.
+	// (Int32 works since ints must be smaller than 2147483648=2^31.)
+	// Since this is signed, -1 indicates a client awaiting an ack (0) of its connect message.
+	lastAck atomic.Int32
+
+	// maxAckable is the maximum length we will accept an ack for.
+	maxAckable atomic.Int32
+	// ackLock guards ackCh.
+	ackLock sync.Mutex
+	// ackCh is closed (and replaced) whenever lastAck advances, waking anything waiting on an ack.
+	ackCh chan struct{}
+
+	// writeBuffer is the session's data to be sent that hasn't yet been acked by the peer.
+	// writeBuffer[0] is at stream position writeBase, so the total length written is
+	// writeBase + len(writeBuffer).
+	writeBuffer []byte
+	writeBase   int
+	// cwnd caps how much sent data may be awaiting an ack from the peer.
+	cwnd *congestionWindow
+	// rtt measures round trip times to determine the retransmission timeout.
+	rtt *rttEstimator
+
+	// stats counts traffic and anomalies for Session.Stats.
+	stats sessionStats
+
+	// Deadlines for blocking Read and Write calls; see net.Conn.
+	readDeadline  *deadline
+	writeDeadline *deadline
+
+	// linger is how long Close waits for unacknowledged data to be acked; see SetLinger.
+	linger atomic.Int64
+	// closing is set once Close has been called, so further writes are refused while we flush.
+	closing atomic.Bool
+	// noDelay disables write coalescing; see SetNoDelay.
+	noDelay atomic.Bool
+	// peerClosed is set when a client's peer closes the session, so that a dial
+	// can tell a refused connect from one that timed out.
+	peerClosed atomic.Bool
+
+	// isClient distinguishes server and client sessions
+	isClient bool
+}
+
+// Session implements net.Conn, so it can be used anywhere a TCP connection would be.
+var _ net.Conn = (*Session)(nil)
+
+// newSession instantiates the state needed to handle an LRCP session and kicks off read and write workers.
+// A client session starts out waiting for the ack of its connect.
+func newSession(addr net.Addr, id int, conn net.PacketConn, config Config, cleanup func(s *Session), isClient bool) *Session {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Session{
+		addr:             addr,
+		ID:               id,
+		config:           config,
+		conn:             conn,
+		cleanup:          cleanup,
+		receiveCh:        make(chan *message, config.ReceiveBufferSize),
+		readCh:           make(chan bool, 1),
+		writeCh:          make(chan bool, 1),
+		fastRetransmitCh: make(chan bool, 1),
+		ctx:              ctx,
+		cancel:           cancel,
+		readBuffer:       make([]byte, 0, minBufferSize),
+		writeBuffer:      make([]byte, 0, minBufferSize),
+		cwnd:             newCongestionWindow(),
+		rtt:              newRTTEstimator(config),
+		readDeadline:     newDeadline(),
+		writeDeadline:    newDeadline(),
+		ackCh:            make(chan struct{}),
+		isClient:         isClient,
+	}
+	if isClient {
+		// We're still waiting for ack 0 while attempting to connect
+		s.lastAck.Store(-1)
+	}
+	s.linger.Store(int64(DefaultLinger))
+	s.noDelay.Store(config.NoDelay)
+	go s.readWorker()
+	go s.writeWorker()
+	return s
+}
+
+// Key returns the string key of the session for lookup and logging.
+func (s *Session) Key() string {
+	return sessionKey(s.addr, s.ID)
+}
+
+// RTO returns the session's current retransmission timeout, including any backoff.
+// Useful for debugging.
+func (s *Session) RTO() time.Duration {
+	return s.rtt.RTO()
+}
+
+// SRTT returns the session's smoothed round trip time, or 0 if it hasn't been measured yet.
+// Useful for debugging.
+func (s *Session) SRTT() time.Duration {
+	return s.rtt.SRTT()
+}
+
+// LocalAddr returns the local network address of the session's underlying connection.
+func (s *Session) LocalAddr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+// RemoteAddr returns the peer's network address.
+func (s *Session) RemoteAddr() net.Addr {
+	return s.addr
+}
+
+// SetDeadline sets both the read and write deadlines; see net.Conn.
+func (s *Session) SetDeadline(t time.Time) error {
+	s.readDeadline.set(t)
+	s.writeDeadline.set(t)
+	return nil
+}
+
+// SetReadDeadline sets the deadline for current and future Read calls.
+// Once exceeded, Read returns os.ErrDeadlineExceeded. A zero value for t means Read will not time out.
+func (s *Session) SetReadDeadline(t time.Time) error {
+	s.readDeadline.set(t)
+	return nil
+}
+
+// SetWriteDeadline sets the deadline for current and future Write calls.
+// Once exceeded, Write returns os.ErrDeadlineExceeded. A zero value for t means Write will not time out.
+func (s *Session) SetWriteDeadline(t time.Time) error {
+	s.writeDeadline.set(t)
+	return nil
+}
+
+// Read implements the io.Reader interface on the session's data buffer.
+// Blocks until data is available, the session is closed (io.EOF once all data has been read),
+// or the read deadline passes (os.ErrDeadlineExceeded.)
+func (s *Session) Read(b []byte) (int, error) {
+	if s.readDeadline.exceeded() {
+		return 0, os.ErrDeadlineExceeded
+	}
+	if len(b) == 0 {
+		return 0, nil
+	}
+	for {
+		s.readLock.Lock()
+		if s.readIndex < s.readLength() {
+			n := copy(b, s.readBuffer[s.readIndex-s.readBase:])
+			s.readIndex += n
+			// Let go of data once it's been read.
+			var dropped int
+			s.readBuffer, dropped = discard(s.readBuffer, s.readIndex-s.readBase)
+			s.readBase += dropped
+			s.readLock.Unlock()
+			return n, nil
+		}
+		s.readLock.Unlock()
+
+		select {
+		case <-s.ctx.Done():
+			// If we're closed AND we've read all the data, return EOF.
+			// Otherwise, proceed as normal. It's fine to read from a closed session.
+			s.readLock.Lock()
+			drained := s.readIndex >= s.readLength()
+			s.readLock.Unlock()
+			if drained {
+				return 0, io.EOF
+			}
+		case <-s.readCh:
+			// Data may be available for reading.
+		case <-s.readDeadline.wait():
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+}
+
+// appendRead appends incoming data to the session, returning final length of all contiguous data and an error.
+// Data that arrives ahead of a gap is held in the reorder buffer until the gap is filled,
+// and data overlapping what we already have only contributes its new bytes.
+// Error is non-nil if pos is invalid, if no new contiguous data was appended, or if the data
+// exceeds max transmission size.
+func (s *Session) appendRead(pos int, b []byte) (int, error) {
+	s.readLock.Lock()
+	defer s.readLock.Unlock()
+	// This one is tricky! Do we want to allow appending to a closed session?
+	// i.e. do we continue to accept data after the session is closed?
+	// This could be due to packets arriving out of order, and close beats out previously sent data.
+	// On the other hand, if they've sent a close, it's reasonable to assume their last packet has been ACK'd.
+	select {
+	case <-s.ctx.Done():
+		return s.readLength(), fmt.Errorf("session %s is closed", s.Key())
+	default:
+	}
+
+	if pos < 0 {
+		return s.readLength(), fmt.Errorf("invalid position %d < 0", pos)
+	}
+	if total := pos + len(b); total > maxInt {
+		return s.readLength(), fmt.Errorf("total data length %d exceeds max transmission size %d", total, maxInt)
+	}
+	length := s.readLength()
+	// Nothing is accepted past the receive window, however it arrives.
+	window := s.readIndex + s.config.ReceiveWindow
+	if pos >= window {
+		return length, fmt.Errorf("%w: position %d >= read index %d + window %d", errReceiveWindowFull, pos, s.readIndex, s.config.ReceiveWindow)
+	}
+	if pos > length {
+		// Ahead of a gap. Hold onto what fits in the reorder buffer; the ack stays at the current length.
+		if !s.bufferSegment(pos, b) {
+			return length, fmt.Errorf("%w: position %d > current data length %d", errReorderBufferFull, pos, length)
+		}
+		return length, fmt.Errorf("%w: position %d > current data length %d", errOutOfOrder, pos, length)
+	}
+	if pos+len(b) <= length {
+		return length, fmt.Errorf("%w: position %d + %d bytes <= current data length %d", errDuplicateData, pos, len(b), length)
+	}
+	// Skip any bytes we've already received, and any that don't fit in the window.
+	b = b[length-pos:]
+	var err error
+	if length+len(b) > window {
+		b = b[:window-length]
+		err = fmt.Errorf("%w: data truncated at read index %d + window %d", errReceiveWindowFull, s.readIndex, s.config.ReceiveWindow)
+	}
+	log.Printf("Session[%s].appendRead: appending %d-bytes at pos %d for total %d", s.Key(), len(b), length, length+len(b))
+	s.readBuffer = append(s.readBuffer, b...)
+	s.drainReorderBuffer()
+	return s.readLength(), err
+}
+
+// inWindow reports whether an ack or data message is plausible from the session's peer:
+// data starting within the receive window (the same bound appendRead applies) or at no
+// more than we've received (so keepalive probes are answered even when the window is
+// full), or an ack of no more than we've sent. Used by a hardened Listener to drop forged
+// messages (see Config.Hardened.)
+func (s *Session) inWindow(msg *message) bool {
+	switch msg.Type {
+	case `data`:
+		s.readLock.Lock()
+		defer s.readLock.Unlock()
+		return msg.Pos < s.readIndex+s.config.ReceiveWindow || msg.Pos <= s.readLength()
+	case `ack`:
+		return msg.Length <= int(s.maxAckable.Load())
+	}
+	return true
+}
+
+// readLength returns the contiguous length of data received.
+// Caller must hold readLock.
+func (s *Session) readLength() int {
+	return s.readBase + len(s.readBuffer)
+}
+
+// Errors returned by appendRead when data isn't appended, so readWorker can tell them apart.
+var (
+	errOutOfOrder        = errors.New("data buffered out of order")
+	errReorderBufferFull = errors.New("reorder buffer full; data dropped")
+	errDuplicateData     = errors.New("duplicate data")
+	// errReceiveWindowFull may accompany a partial append, up to the window.
+	errReceiveWindowFull = errors.New("receive window full; data refused")
+)
+
+// segment is a run of received data starting at stream position pos.
+type segment struct {
+	pos  int
+	data []byte
+}
+
+// end returns the stream position just past the segment's data.
+func (seg segment) end() int {
+	return seg.pos + len(seg.data)
+}
+
+// bufferSegment stores data at pos in the reorder buffer, merging it with any
+// segments it overlaps or touches. Data beyond Config.ReorderBufferSize bytes past the
+// contiguous length, or beyond the receive window, is trimmed. Returns false if nothing
+// could be buffered.
+// Caller must hold readLock.
+func (s *Session) bufferSegment(pos int, b []byte) bool {
+	limit := min(s.readLength()+s.config.ReorderBufferSize, s.readIndex+s.config.ReceiveWindow)
+	if pos >= limit {
+		return false
+	}
+	if pos+len(b) > limit {
+		b = b[:limit-pos]
+	}
+	if len(b) == 0 {
+		return false
+	}
+	end := pos + len(b)
+
+	// Find the run of segments [i, j) that overlap or touch [pos, end).
+	i := 0
+	for i < len(s.reorderBuffer) && s.reorderBuffer[i].end() < pos {
+		i++
+	}
+	j := i
+	for j < len(s.reorderBuffer) && s.reorderBuffer[j].pos <= end {
+		j++
+	}
+	if i == j {
+		// No neighbors; insert a copy as-is.
+		s.reorderBuffer = slices.Insert(s.reorderBuffer, i, segment{pos: pos, data: bytes.Clone(b)})
+		return true
+	}
+
+	// Merge everything in [i, j) with the new data into a single segment.
+	mergedPos := min(pos, s.reorderBuffer[i].pos)
+	mergedEnd := max(end, s.reorderBuffer[j-1].end())
+	merged := make([]byte, mergedEnd-mergedPos)
+	for _, seg := range s.reorderBuffer[i:j] {
+		copy(merged[seg.pos-mergedPos:], seg.data)
+	}
+	copy(merged[pos-mergedPos:], b)
+	s.reorderBuffer = slices.Replace(s.reorderBuffer, i, j, segment{pos: mergedPos, data: merged})
+	return true
+}
+
+// drainReorderBuffer moves any buffered segments that are now contiguous with
+// readBuffer into readBuffer.
+// Caller must hold readLock.
+func (s *Session) drainReorderBuffer() {
+	drained := 0
+	for _, seg := range s.reorderBuffer {
+		length := s.readLength()
+		if seg.pos > length {
+			break
+		}
+		if seg.end() > length {
+			log.Printf("Session[%s].appendRead: appending %d buffered bytes at pos %d for total %d",
+				s.Key(), seg.end()-length, length, seg.end())
+			s.readBuffer = append(s.readBuffer, seg.data[length-seg.pos:]...)
+		}
+		drained++
+	}
+	s.reorderBuffer = slices.Delete(s.reorderBuffer, 0, drained)
+}
+
+// Write data to the buffer, returning number of bytes written and an error.
+// Blocks while the send buffer is full (see Config.SendBufferSize) until the peer's
+// acks make room for the rest of b.
+// Errors if the session is closed, the write deadline has passed, or the total data
+// length would exceed maxInt; n is then the number of bytes buffered before the error.
+func (s *Session) Write(b []byte) (int, error) {
+	s.writerLock.Lock()
+	defer s.writerLock.Unlock()
+	var written int
+	for {
+		// Grab the channel before checking, so we can't miss an ack in between.
+		acked := s.ackChanged()
+		n, err := s.write(b[written:])
+		written += n
+		if err != nil || written == len(b) {
+			return written, err
+		}
+		select {
+		case <-s.ctx.Done():
+			return written, fmt.Errorf("session %s is closed: %w", s.Key(), net.ErrClosed)
+		case <-s.writeDeadline.wait():
+			return written, os.ErrDeadlineExceeded
+		case <-acked:
+		}
+	}
+}
+
+// write appends as much of b as fits in the send buffer, returning the number of bytes appended.
+func (s *Session) write(b []byte) (int, error) {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	select {
+	case <-s.ctx.Done():
+		// No point in writing to a closed session.
+		return 0, fmt.Errorf("session %s is closed: %w", s.Key(), net.ErrClosed)
+	default:
+	}
+	if s.closing.Load() {
+		return 0, fmt.Errorf("session %s is closing: %w", s.Key(), net.ErrClosed)
+	}
+	if s.writeDeadline.exceeded() {
+		return 0, os.ErrDeadlineExceeded
+	}
+	// Acked bytes may linger in writeBuffer until discarded, so count only unacked ones.
+	// (A client's lastAck is -1 until its connect is acked, hence the max.)
+	unacked := s.writeBase + len(s.writeBuffer) - max(int(s.lastAck.Load()), s.writeBase)
+	b = b[:min(len(b), max(s.config.SendBufferSize-unacked, 0))]
+	total := s.writeBase + len(s.writeBuffer) + len(b)
+	if total > maxInt {
+		return 0, fmt.Errorf("total data length %d exceeds max transmission size %d", total, maxInt)
+	}
+	s.writeBuffer = append(s.writeBuffer, b...)
+	s.notifyWrite()
+	return len(b), nil
+}
+
+// notifyWrite wakes writeWorker to send any pending data.
+// writeCh is 1-buffered. As long as *something* is queued, the worker will wake, so we never block.
+func (s *Session) notifyWrite() {
+	select {
+	case s.writeCh <- true:
+	default:
+	}
+}
+
+// Abort closes a Session's goroutines without notifying its peer or cleaning
+// up resources (see Session.Close().) Useful when a Session has been spawned
+// but should be discarded before use.
+func (s *Session) Abort() {
+	// Don't compete for Close lock. That race condition is actually acceptable
+	// here; if the Session internally decides to Close, we shouldn't try to
+	// prevent that by acquiring the lock first.
+	s.cancel()
+}
+
+// SetLinger sets how long Close blocks waiting for the peer to acknowledge data that has been
+// written but not yet acked, similar to net.TCPConn.SetLinger.
+// If d < 0, Close waits indefinitely (or until the session expires.)
+// If d == 0, Close discards any unacknowledged data and closes immediately.
+// If d > 0, Close waits up to d before closing anyway. Defaults to DefaultLinger.
+func (s *Session) SetLinger(d time.Duration) error {
+	s.linger.Store(int64(d))
+	return nil
+}
+
+// SetNoDelay controls write coalescing, similar to net.TCPConn.SetNoDelay.
+// By default (noDelay false) small writes made while earlier data is still
+// unacknowledged are held back for up to CoalesceDelay, so they can share a message.
+// Latency-sensitive applications that make small writes can set noDelay to true
+// to send every write as soon as the congestion window allows.
+func (s *Session) SetNoDelay(noDelay bool) error {
+	s.noDelay.Store(noDelay)
+	s.notifyWrite()
+	return nil
+}
+
+// Close current session gracefully. Can be safely called multiple times.
+// Waits for the peer to acknowledge everything written, up to the linger timeout
+// (see SetLinger), then informs the peer of the disconnect and releases the session.
+// Use Abort to tear down a session immediately.
+// Returns an error only if the close message couldn't be sent.
+func (s *Session) Close() error {
+	s.closing.Store(true)
+	s.flush()
+	return s.shutdown()
+}
+
+// flush blocks until all written data has been acknowledged, the linger timeout passes,
+// or the session is closed by other means.
+func (s *Session) flush() {
+	linger := time.Duration(s.linger.Load())
+	if linger == 0 {
+		return
+	}
+	var timeout <-chan time.Time
+	if linger > 0 {
+		timer := time.NewTimer(linger)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	for {
+		// Grab the channel before checking, so we can't miss an ack in between.
+		acked := s.ackChanged()
+		s.writeLock.Lock()
+		unacked := s.writeBase + len(s.writeBuffer) - int(s.lastAck.Load())
+		s.writeLock.Unlock()
+		if unacked <= 0 {
+			return
+		}
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-timeout:
+			log.Printf(`Session[%s].Close: gave up waiting for [%d] unacknowledged bytes after [%s]`, s.Key(), unacked, linger)
+			return
+		case <-acked:
+		}
+	}
+}
+
+// shutdown closes the current session immediately, without waiting for
+// unacknowledged data. Can be safely called multiple times.
+// Signals other goroutines to close, informs peer of disconnect, and signals
+// Listener to reap this session.
+//
+// A few things are handled by s.cleanup that shouldn't be handled here, since
+// they vary by client and server implementation.
+// * Removing the session from the session store
+// * Closing the session's connection (server shares one conn, clients own theirs)
+func (s *Session) shutdown() error {
+
+	// Needed for a race condition: it's possible for two calls to shutdown to enter the default
+	// case before one completes a call to s.cancel().
+	s.closeLock.Lock()
+	defer s.closeLock.Unlock()
+
+	// Only run cleanup once - if we haven't canceled yet.
+	var err error
+	select {
+	case <-s.ctx.Done():
+	default:
+		// This needs to be inside the select.
+		s.cancel()
+		err = s.sendClose()
+		// cleanup must be last since we can't sendClose if the conn is cleaned up.
+		s.cleanup(s)
+	}
+	return err
+}
+
+// discardAcked lets go of written data once the peer has acked it.
+func (s *Session) discardAcked() {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	var dropped int
+	s.writeBuffer, dropped = discard(s.writeBuffer, int(s.lastAck.Load())-s.writeBase)
+	s.writeBase += dropped
+}
+
+// ackChanged returns a channel that will be closed the next time lastAck advances.
+func (s *Session) ackChanged() <-chan struct{} {
+	s.ackLock.Lock()
+	defer s.ackLock.Unlock()
+	return s.ackCh
+}
+
+// broadcastAck wakes everything waiting on ackChanged.
+func (s *Session) broadcastAck() {
+	s.ackLock.Lock()
+	defer s.ackLock.Unlock()
+	close(s.ackCh)
+	s.ackCh = make(chan struct{})
+}
+
+// readWorker is a per-session goroutine that receive messages, appends their
+// data to the session's readBuffer, and signals to Session.Read that data is
+// available.
+func (s *Session) readWorker() {
+	timeoutTimer := time.NewTimer(s.config.ReadTimeout)
+
+	// Delayed acks (see AckEvery.) ackTimer only runs while an ack is held back;
+	// ackTimerC is nil the rest of the time, so the select ignores it.
+	ackTimer := time.NewTimer(s.config.AckDelay)
+	ackTimer.Stop()
+	defer ackTimer.Stop()
+	var ackTimerC <-chan time.Time
+	// heldAcks counts data messages received since the last ack, up to length heldLength.
+	var heldAcks, heldLength int
+	// dupAcks counts acks of lastAck received since it last advanced.
+	var dupAcks int
+
+	// Keepalives (see KeepAliveProbes.) keepAliveC is nil if they're disabled, or until
+	// a client's connect has been acked: a probe before then would reach a Listener as
+	// data for an unknown session, and be answered with a close.
+	// probes counts keepalives sent since we last heard from the peer.
+	var keepAliveTimer *time.Timer
+	var keepAliveC <-chan time.Time
+	startKeepAlive := func() {
+		if s.config.KeepAlive > 0 && keepAliveTimer == nil {
+			keepAliveTimer = time.NewTimer(s.config.KeepAlive)
+			keepAliveC = keepAliveTimer.C
+		}
+	}
+	defer func() {
+		if keepAliveTimer != nil {
+			keepAliveTimer.Stop()
+		}
+	}()
+	if s.lastAck.Load() >= 0 {
+		startKeepAlive()
+	}
+	var probes int
+	ack := func(length int) {
+		if ackTimerC != nil && !ackTimer.Stop() {
+			<-ackTimer.C // Must Stop timer and drain the channel before a Reset
+		}
+		ackTimerC = nil
+		heldAcks = 0
+		s.sendAck(length)
+	}
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-timeoutTimer.C:
+			log.Printf(`Session[%s].readWorker: no reply from peer; alerting timeout`, s.Key())
+			s.shutdown()
+			return
+		case <-ackTimerC:
+			ackTimerC = nil
+			heldAcks = 0
+			s.sendAck(heldLength)
+		case <-keepAliveC:
+			if probes >= s.config.KeepAliveProbes {
+				log.Printf(`Session[%s].readWorker: [%d] keepalives unanswered; alerting timeout`, s.Key(), probes)
+				s.shutdown()
+				return
+			}
+			probes++
+			if err := s.sendProbe(); err != nil {
+				log.Printf(`Session[%s].readWorker: %v`, s.Key(), err)
+			}
+			keepAliveTimer.Reset(s.config.KeepAlive)
+		case msg := <-s.receiveCh:
+			// Reset session timeout
+			if !timeoutTimer.Stop() { // Must Stop timer and drain the channel before a Reset
+				<-timeoutTimer.C
+			}
+			timeoutTimer.Reset(s.config.ReadTimeout)
+			if keepAliveC != nil {
+				if !keepAliveTimer.Stop() {
+					<-keepAliveTimer.C // Must Stop timer and drain the channel before a Reset
+				}
+				keepAliveTimer.Reset(s.config.KeepAlive)
+				probes = 0
+			}
+
+			switch msg.Type {
+			case `ack`:
+				// If the ack'd length is greater than what we've sent, close the session.
+				maxAckable := int(s.maxAckable.Load())
+				if msg.Length > maxAckable {
+					log.Printf(`Session[%s].readWorker: peer ack length [%d] greater than maxAckable [%d]; closing session`, s.Key(), msg.Length, maxAckable)
+					s.shutdown()
+					return
+				}
+
+				// As long as ack'd length > session.lastAck, try to update session.lastAck
+				for {
+					lastAck := s.lastAck.Load()
+					if msg.Length > int(lastAck) {
+						if s.lastAck.CompareAndSwap(lastAck, int32(msg.Length)) { // success
+							// Grow the window (unless this is the ack of a client's connect),
+							// then let writeWorker know it may have room to send more.
+							if lastAck >= 0 {
+								s.cwnd.onAck(msg.Length - int(lastAck))
+								s.rtt.onAck(msg.Length)
+							} else {
+								// Connected; time to start any keepalives.
+								startKeepAlive()
+							}
+							dupAcks = 0
+							s.discardAcked()
+							s.notifyWrite()
+							s.broadcastAck()
+							break
+						}
+					} else { // ack <= session.lastAck; nothing new
+						s.stats.duplicateAcks.Add(1)
+						// Repeated acks of lastAck while data is in flight mean the peer is
+						// receiving later segments but is missing the one at lastAck.
+						if msg.Length == int(lastAck) && lastAck >= 0 && lastAck < s.maxAckable.Load() {
+							if dupAcks++; dupAcks == dupAckThreshold {
+								select {
+								case s.fastRetransmitCh <- true:
+								default:
+								}
+							}
+						}
+						break
+					}
+				}
+			case `data`:
+				n, err := s.appendRead(msg.Pos, msg.Data)
+				// Always send an ack *of current length*, regardless of error.
+				// In-order data may be acked later, but anything else (including data
+				// that fills a gap, moving the reorder buffer along) is acked right away.
+				heldAcks++
+				heldLength = n
+				switch {
+				case err != nil || n > msg.Pos+len(msg.Data) || heldAcks >= s.config.AckEvery:
+					ack(n)
+				case ackTimerC == nil:
+					ackTimer.Reset(s.config.AckDelay)
+					ackTimerC = ackTimer.C
+				}
+				if err != nil {
+					switch {
+					case errors.Is(err, errOutOfOrder):
+						s.stats.outOfOrder.Add(1)
+					case errors.Is(err, errReorderBufferFull):
+						s.stats.outOfOrderDrops.Add(1)
+					case errors.Is(err, errDuplicateData):
+						s.stats.duplicateData.Add(1)
+					case errors.Is(err, errReceiveWindowFull):
+						s.stats.windowDrops.Add(1)
+					}
+					log.Printf(`Session[%s].readWorker: error appending data: %s`, s.Key(), err)
+					// Data may have been appended up to the window, so still wake the reader.
+					if !errors.Is(err, errReceiveWindowFull) {
+						continue
+					}
+				}
+				// Notify reader that data is available.
+				// readCh is 1-buffered. As long as *something* is queued, we can move on. No need to block.
+				select {
+				case s.readCh <- true:
+				default:
+				}
+			case `connect`, `close`:
+				log.Printf(`Session[%s].readWorker: unexpected [%s] message forwarded to reader`, s.Key(), msg.Type)
+			default:
+				log.Printf(`Session[%s].readWorker: unexpected message type [%s]`, s.Key(), msg.Type)
+			}
+		}
+	}
+}
+
+// receive is a non-blocking method for passing ACK or DATA messages to a Session's readWorker.
+// If the readWorker is busy and the internal receive channel is full, an error is returned.
+// Other message types will also produce an error.
+func (s *Session) receive(msg *message) error {
+	if msg.Type != "ack" && msg.Type != "data" {
+		return fmt.Errorf("session will only receive ack or data messages (got [%s])", msg.Type)
+	}
+	select {
+	case s.receiveCh <- msg:
+		return nil
+	default:
+		s.stats.receiveDrops.Add(1)
+		return errors.New("receive channel full")
+	}
+}
+
+// writeWorker is a per-session goroutine that sends data from the session's writeBuffer.
+// It sleeps until Session.Write signals writeCh or the retransmission timer fires,
+// so an idle session costs nothing.
+func (s *Session) writeWorker() {
+	// The retransmission timer is only armed while we're waiting on the peer:
+	// either for an ack of sent data, or (for clients) an ack of our connect.
+	retransmissionTimer := time.NewTimer(s.rtt.RTO())
+	timerArmed := true
+	if !s.isClient {
+		retransmissionTimer.Stop()
+		timerArmed = false
+	}
+	defer retransmissionTimer.Stop()
+	// timerAck is the value of lastAck when the timer was last armed.
+	// The timer is restarted whenever the peer acks something new, so it only fires
+	// once the peer has made no progress for a full timeout.
+	timerAck := s.lastAck.Load()
+	armTimer := func() {
+		if timerArmed && !retransmissionTimer.Stop() {
+			<-retransmissionTimer.C // Must Stop timer and drain the channel before a Reset
+		}
+		retransmissionTimer.Reset(s.rtt.RTO())
+		timerArmed = true
+		timerAck = s.lastAck.Load()
+	}
+	// Clients start at -1 and don't send any data until their connect is ack'd.
+	writeIndex := int(s.lastAck.Load())
+
+	// Write coalescing (see SetNoDelay.) While a short message of new data is held back,
+	// holdUntil is when it must be sent regardless, and holdTimerC fires then.
+	holdTimer := time.NewTimer(s.config.CoalesceDelay)
+	holdTimer.Stop()
+	defer holdTimer.Stop()
+	var holdTimerC <-chan time.Time
+	var holdUntil time.Time
+
+	// Reuse a single message for packing
+	msg := &message{Type: `data`, Session: s.ID}
+	// Buffer for encoding messages
+	buf := make([]byte, maxMessageSize)
+
+	// tryWrite sends a single message from writeIndex, returning true if
+	// anything was sent (and so there may be more to send.)
+	// Wrapping this in a function for easy defer semantics.
+	tryWrite := func() bool {
+		buf = buf[:cap(buf)] // Re-extend for full length writes
+
+		s.writeLock.Lock()
+		defer s.writeLock.Unlock()
+		// No point resending anything the peer has acked since we last rewound.
+		// This also keeps writeIndex within writeBuffer, since acked data may have been discarded.
+		lastAck := int(s.lastAck.Load())
+		writeIndex = max(writeIndex, lastAck)
+		if writeIndex >= s.writeBase+len(s.writeBuffer) {
+			// Nothing to send
+			return false
+		}
+		// Don't exceed the congestion window. Wait for a full segment's worth of room
+		// (or whatever's left to send) rather than dribbling out tiny messages.
+		offset := writeIndex - s.writeBase
+		pending := len(s.writeBuffer) - offset
+		room := s.cwnd.Size() - (writeIndex - lastAck)
+		if room < min(pending, maxSegmentSize) {
+			return false
+		}
+		// Nagle: while earlier data is unacknowledged, hold back a short message of new data
+		// so that later writes can join it, until the peer acks, a full segment's worth
+		// is pending, or CoalesceDelay passes. Retransmissions are never held.
+		if pending < maxSegmentSize && writeIndex > lastAck && writeIndex >= int(s.maxAckable.Load()) && !s.noDelay.Load() {
+			if holdUntil.IsZero() {
+				holdUntil = time.Now().Add(s.config.CoalesceDelay)
+				holdTimer.Reset(s.config.CoalesceDelay)
+				holdTimerC = holdTimer.C
+			}
+			if time.Now().Before(holdUntil) {
+				return false
+			}
+		}
+		if !holdUntil.IsZero() {
+			if !holdTimer.Stop() && holdTimerC != nil {
+				<-holdTimer.C // Must Stop timer and drain the channel before a Reset
+			}
+			holdTimerC = nil
+			holdUntil = time.Time{}
+		}
+		// Send from current writeIndex, incrementing as we go.
+		msg.Pos = writeIndex
+		packedN := msg.pack(s.writeBuffer[offset : offset+min(pending, room)])
+		if err := msg.validate(); err != nil {
+			log.Printf(`Session[%s].writeWorker: error validating message [%+v]: %s`, s.Key(), msg, err)
+			return false
+		}
+		encodedN, err := msg.encode(buf)
+		if err != nil {
+			log.Printf(`Session[%s].writeWorker: error encoding message: %s`, s.Key(), err)
+			return false
+		}
+		log.Printf(`Session[%s].writeWorker: sending [%d]-byte message with [%d]-packed bytes from write index [%d]`,
+			s.Key(), encodedN, packedN, writeIndex)
+		_, err = s.sendData(buf[:encodedN])
+		if err != nil {
+			// For now, we ignore the number of bytes sent on error,
+			// since we can always resend them anyway if we bail out here.
+			// The retransmission timer will get us going again.
+			log.Printf(`Session[%s].writeWorker: error sending data message: %s`, s.Key(), err)
+			return false
+		}
+		// Only time new data; acks of retransmitted data are ambiguous.
+		if writeIndex >= int(s.maxAckable.Load()) {
+			s.rtt.onSend(writeIndex + packedN)
+		} else {
+			s.stats.retransmissions.Add(1)
+		}
+		writeIndex += packedN
+		// Update maxAckable if we've sent more data than it.
+		for { // loop until we don't need to update
+			maxAckable := s.maxAckable.Load()
+			if writeIndex > int(maxAckable) {
+				if s.maxAckable.CompareAndSwap(maxAckable, int32(writeIndex)) { // success
+					break
+				}
+			} else { // writeIndex <= maxAckable; ignore
+				break
+			}
+		}
+		return true
+	}
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			log.Printf(`Session[%s].writeWorker closed`, s.Key())
+			return
+		case <-retransmissionTimer.C:
+			timerArmed = false
+			lastAck := int(s.lastAck.Load())
+			inFlight := int(s.maxAckable.Load()) - lastAck
+			// The peer may have acked everything just as the timer fired; if so, nothing's lost.
+			if lastAck >= 0 && inFlight <= 0 {
+				break
+			}
+			// Peer hasn't acked anything we've sent within the timeout; assume it's been lost.
+			s.rtt.onTimeout()
+			if lastAck >= 0 {
+				s.cwnd.onTimeout(inFlight)
+				log.Printf(`Session[%s].writeWorker: retransmission timeout with [%d] bytes in flight; window now [%d], RTO now [%s]`,
+					s.Key(), inFlight, s.cwnd.Size(), s.rtt.RTO())
+			}
+			// Reset writeIndex to lastAck
+			writeIndex = lastAck
+			// If we're a client and have never been ack'd, resend initial connect
+			if writeIndex < 0 {
+				s.stats.retransmissions.Add(1)
+				err := s.sendConnect()
+				if err != nil {
+					log.Printf(`Session[%s].writeWorker failed to resend connect: %v`, s.Key(), err)
+				}
+			}
+		case <-s.writeCh:
+			// If our connect was just ack'd, we can start sending.
+			if writeIndex < 0 {
+				writeIndex = int(s.lastAck.Load())
+			}
+		case <-holdTimerC:
+			// Held data is due; tryWrite will send it.
+			holdTimerC = nil
+		case <-s.fastRetransmitCh:
+			// Resend just the segment at lastAck, then carry on from where we were.
+			// The window is halved as for a timeout, but the RTO isn't backed off.
+			lastAck := int(s.lastAck.Load())
+			if inFlight := int(s.maxAckable.Load()) - lastAck; inFlight > 0 {
+				s.stats.fastRetransmits.Add(1)
+				s.rtt.onRetransmit()
+				s.cwnd.onTimeout(inFlight)
+				log.Printf(`Session[%s].writeWorker: fast retransmit from [%d] with [%d] bytes in flight; window now [%d]`,
+					s.Key(), lastAck, inFlight, s.cwnd.Size())
+				resumeIndex := writeIndex
+				writeIndex = lastAck
+				tryWrite()
+				writeIndex = max(writeIndex, resumeIndex)
+			}
+		}
+
+		// Note: this means that we don't try to eagerly send data before our connect is ACK'd.
+		if writeIndex >= 0 { // -1 until we get initial ack
+			for tryWrite() {
+			}
+		}
+
+		// Keep the timer running as long as anything is unacknowledged,
+		// restarting it whenever the peer makes progress, and stop it once
+		// everything is acked so that it doesn't fire on an idle session.
+		lastAck := s.lastAck.Load()
+		if lastAck < s.maxAckable.Load() || lastAck < 0 {
+			if !timerArmed || lastAck > timerAck {
+				armTimer()
+			}
+		} else if timerArmed {
+			if !retransmissionTimer.Stop() {
+				<-retransmissionTimer.C // Drain, so a later Reset doesn't see a stale expiry
+			}
+			timerArmed = false
+		}
+	}
+}
+
+// send writes a single message to the session's peer.
+func (s *Session) send(msg []byte) (int, error) {
+	n, err := s.conn.WriteTo(msg, s.addr)
+	s.stats.sent(n)
+	return n, err
+}
+
+// sendAck sends an acknowledgement of a given session length.
+// The session's current length isn't strictly used, since we sometimes need to
+// send something else.
+// For example, we should always respond to a duplicate connect with /ack/SESSION/0/
+// (Unclear if *any* ack is fine in that case, but docs specify to send 0.)
+func (s *Session) sendAck(length int) error {
+	msg := []byte(fmt.Sprintf(`/ack/%d/%d/`, s.ID, length))
+	n, err := s.send(msg)
+	s.stats.acksSent.Add(1)
+	if err != nil {
+		return fmt.Errorf("Session[%s].sendAck: error sending ack message: %s", s.Key(), err)
+	}
+	if n != len(msg) {
+		return fmt.Errorf("Session[%s].sendAck: short write sending ack message: %d != %d", s.Key(), n, len(msg))
+	}
+	return nil
+}
+
+// sendProbe sends a keepalive probe: empty data at the length the peer has acked.
+// The peer has all of that, so it answers with an ack of its current length.
+func (s *Session) sendProbe() error {
+	msg := []byte(fmt.Sprintf(`/data/%d/%d//`, s.ID, max(s.lastAck.Load(), 0)))
+	n, err := s.send(msg)
+	if err != nil {
+		return fmt.Errorf("Session[%s].sendProbe: error sending keepalive probe: %s", s.Key(), err)
+	}
+	if n != len(msg) {
+		return fmt.Errorf("Session[%s].sendProbe: short write sending keepalive probe: %d != %d", s.Key(), n, len(msg))
+	}
+	return nil
+}
+
+// sendConnect sends a connect message to the session's peer.
+func (s *Session) sendConnect() error {
+	msg := []byte(fmt.Sprintf(`/connect/%d/`, s.ID))
+	n, err := s.send(msg)
+	if err != nil {
+		return fmt.Errorf("Session[%s].sendConnect: error sending connect message: %s", s.Key(), err)
+	}
+	if n != len(msg) {
+		return fmt.Errorf("Session[%s].sendConnect: short write sending connect message: %d != %d", s.Key(), n, len(msg))
+	}
+	return nil
+
+}
+
+// sendData sends a data message to the session's peer.
+func (s *Session) sendData(packedData []byte) (int, error) {
+	log.Printf(`Session[%s].sendData: sending [%d] bytes`, s.Key(), len(packedData))
+	return s.send(packedData)
+}
+
+// sendClose sends a close message for sessionID.
+func (s *Session) sendClose() error {
+	msg := []byte(fmt.Sprintf(`/close/%d/`, s.ID))
+	n, err := s.send(msg)
+	if err != nil {
+		return fmt.Errorf("Session[%s].sendClose: error sending close message: %s", s.Key(), err)
+	}
+	if n != len(msg) {
+		return fmt.Errorf("Session[%s].sendClose: short write sending close message: %d != %d", s.Key(), n, len(msg))
+	}
+	return nil
+}
+
+// sendClose sends a close message for the given sessionID.
+// This isn't defined on Session since we may want to close a non-existent session.
+// See Session.Close for closing an existing session.
+func sendClose(sessionID int, addr net.Addr, conn net.PacketConn) error {
+	msg := []byte(fmt.Sprintf(`/close/%d/`, sessionID))
+	n, err := conn.WriteTo(msg, addr)
+	if err != nil {
+		return fmt.Errorf("sendClose: error sending close message for session [%d]: %s", sessionID, err)
+	}
+	if n != len(msg) {
+		return fmt.Errorf("sendClose: short write sending close message for session [%d]: %d != %d", sessionID, n, len(msg))
+	}
+	return nil
+}
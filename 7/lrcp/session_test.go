@@ -0,0 +1,721 @@
+package lrcp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"lrcp/lrcp/lrcptest"
+)
+
+func TestAppendRead(t *testing.T) {
+	type write struct {
+		pos  int
+		data string
+	}
+	cases := []struct {
+		name        string
+		writes      []write
+		wantData    string
+		wantLength  int
+		wantPending int // number of segments left in the reorder buffer
+	}{
+		{
+			name:       "in order",
+			writes:     []write{{0, "abc"}, {3, "def"}},
+			wantData:   "abcdef",
+			wantLength: 6,
+		},
+		{
+			name:        "ahead of gap is buffered, not acked",
+			writes:      []write{{3, "def"}},
+			wantData:    "",
+			wantLength:  0,
+			wantPending: 1,
+		},
+		{
+			name:       "gap filled drains buffer",
+			writes:     []write{{6, "ghi"}, {3, "def"}, {0, "abc"}},
+			wantData:   "abcdefghi",
+			wantLength: 9,
+		},
+		{
+			name:        "partial fill leaves later segment buffered",
+			writes:      []write{{6, "ghi"}, {0, "abc"}},
+			wantData:    "abc",
+			wantLength:  3,
+			wantPending: 1,
+		},
+		{
+			name:        "overlapping segments are merged",
+			writes:      []write{{4, "efg"}, {2, "cdef"}, {8, "ij"}},
+			wantData:    "",
+			wantLength:  0,
+			wantPending: 2,
+		},
+		{
+			name:       "merged segments drain together",
+			writes:     []write{{4, "efg"}, {2, "cdef"}, {7, "hij"}, {0, "ab"}},
+			wantData:   "abcdefghij",
+			wantLength: 10,
+		},
+		{
+			name:       "overlap with received data only appends new bytes",
+			writes:     []write{{0, "abc"}, {1, "bcde"}},
+			wantData:   "abcde",
+			wantLength: 5,
+		},
+		{
+			name:       "duplicate data is ignored",
+			writes:     []write{{0, "abc"}, {0, "ab"}},
+			wantData:   "abc",
+			wantLength: 3,
+		},
+		{
+			name:       "data beyond reorder buffer is dropped",
+			writes:     []write{{ReorderBufferSize + 1, "z"}, {0, "a"}},
+			wantData:   "a",
+			wantLength: 1,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := &Session{ctx: context.Background(), config: (*Config)(nil).withDefaults()}
+			var n int
+			for _, w := range c.writes {
+				n, _ = s.appendRead(w.pos, []byte(w.data))
+			}
+			if n != c.wantLength {
+				t.Fatalf("unexpected length: got %d, want %d", n, c.wantLength)
+			}
+			if !bytes.Equal(s.readBuffer, []byte(c.wantData)) {
+				t.Fatalf(`unexpected data: got "%s", want "%s"`, s.readBuffer, c.wantData)
+			}
+			if len(s.reorderBuffer) != c.wantPending {
+				t.Fatalf("unexpected reorder buffer segments: got %d, want %d", len(s.reorderBuffer), c.wantPending)
+			}
+		})
+	}
+}
+
+// TestReceiveWindow checks that appendRead refuses data beyond what has been read plus
+// the receive window, and accepts it once Read makes room.
+func TestReceiveWindow(t *testing.T) {
+	config := (&Config{ReceiveWindow: 4}).withDefaults()
+	s := &Session{ctx: context.Background(), config: config, readCh: make(chan bool, 1), readDeadline: newDeadline()}
+
+	// Only what fits is appended, and acked.
+	if n, err := s.appendRead(0, []byte("abcdef")); n != 4 || !errors.Is(err, errReceiveWindowFull) {
+		t.Fatalf("expected partial append to 4 with errReceiveWindowFull, got %d, %v", n, err)
+	}
+	// Out-of-order data is held to the window too.
+	if n, err := s.appendRead(5, []byte("f")); n != 4 || !errors.Is(err, errReceiveWindowFull) {
+		t.Fatalf("expected errReceiveWindowFull for data past the window, got %d, %v", n, err)
+	}
+
+	buf := make([]byte, 2)
+	if n, err := s.Read(buf); n != 2 || err != nil {
+		t.Fatalf("unexpected read: %d, %v", n, err)
+	}
+	if n, err := s.appendRead(4, []byte("efgh")); n != 6 || !errors.Is(err, errReceiveWindowFull) {
+		t.Fatalf("expected append to 6 once read, got %d, %v", n, err)
+	}
+	if !bytes.Equal(s.readBuffer, []byte("cdef")) {
+		t.Fatalf(`unexpected data: got "%s", want "cdef"`, s.readBuffer)
+	}
+}
+
+// TestSlidingBuffers checks that a long-lived session's buffers stay small
+// as data is read and acked, rather than growing with everything sent through them.
+func TestSlidingBuffers(t *testing.T) {
+	// No workers, so we can drive the buffers by hand.
+	s := &Session{
+		ctx:           context.Background(),
+		config:        (*Config)(nil).withDefaults(),
+		readCh:        make(chan bool, 1),
+		writeCh:       make(chan bool, 1),
+		readDeadline:  newDeadline(),
+		writeDeadline: newDeadline(),
+	}
+	chunk := bytes.Repeat([]byte("x"), maxSegmentSize)
+	buf := make([]byte, 100)
+	pos := 0
+	for pos < 1<<22 { // 4MiB
+		if _, err := s.appendRead(pos, chunk); err != nil {
+			t.Fatalf("unexpected append error at %d: %v", pos, err)
+		}
+		if _, err := s.Write(chunk); err != nil {
+			t.Fatalf("unexpected write error at %d: %v", pos, err)
+		}
+		pos += len(chunk)
+		// Read in small pieces, and ack everything written.
+		for s.readIndex < pos {
+			if _, err := s.Read(buf); err != nil {
+				t.Fatalf("unexpected read error at %d: %v", s.readIndex, err)
+			}
+		}
+		s.lastAck.Store(int32(pos))
+		s.discardAcked()
+	}
+	if got, want := s.readBase+len(s.readBuffer), pos; got != want {
+		t.Fatalf("unexpected read length: got %d, want %d", got, want)
+	}
+	if got, want := s.writeBase+len(s.writeBuffer), pos; got != want {
+		t.Fatalf("unexpected write length: got %d, want %d", got, want)
+	}
+	if c := cap(s.readBuffer); c > 4*maxSegmentSize {
+		t.Fatalf("read buffer grew to %d bytes", c)
+	}
+	if c := cap(s.writeBuffer); c > 4*maxSegmentSize {
+		t.Fatalf("write buffer grew to %d bytes", c)
+	}
+}
+
+func TestSessionDeadlines(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	s := newSession(conn.LocalAddr(), 1234, conn, (*Config)(nil).withDefaults(), func(*Session) {}, false)
+	defer s.Abort()
+
+	// Read blocks until the deadline passes.
+	s.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	start := time.Now()
+	if _, err := s.Read(make([]byte, 10)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded on read, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Fatalf("read returned before deadline: %s", elapsed)
+	}
+
+	// Clearing the deadline lets data through again.
+	s.SetReadDeadline(time.Time{})
+	if _, err := s.appendRead(0, []byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	s.readCh <- true
+	buf := make([]byte, 10)
+	n, err := s.Read(buf)
+	if err != nil || !bytes.Equal(buf[:n], []byte("abc")) {
+		t.Fatalf(`unexpected read: got "%s", %v`, buf[:n], err)
+	}
+
+	// A deadline in the past fails immediately, even for writes that wouldn't block.
+	s.SetDeadline(time.Now().Add(-time.Second))
+	if _, err := s.Write([]byte("abc")); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded on write, got %v", err)
+	}
+	if _, err := s.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded on read, got %v", err)
+	}
+}
+
+func TestGracefulClose(t *testing.T) {
+	l, err := Listen("lrcp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	client, err := Dial("lrcp", nil, l.Addr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("unexpected dial error: %v", err)
+	}
+	server, err := l.AcceptLRCP()
+	if err != nil {
+		t.Fatalf("unexpected accept error: %v", err)
+	}
+
+	// Close straight after writing; Close should wait for everything to be acked.
+	want := bytes.Repeat([]byte("0123456789"), 10*maxSegmentSize/10)
+	if _, err := client.Write(want); err != nil {
+		t.Fatalf("unexpected write error: %v", err)
+	}
+	if err := client.Close(); err != nil {
+		t.Fatalf("unexpected close error: %v", err)
+	}
+	if _, err := client.Write(want); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected net.ErrClosed writing after close, got %v", err)
+	}
+
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got, err := io.ReadAll(server)
+	if err != nil {
+		t.Fatalf("unexpected read error: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("unexpected data: got %d bytes, want %d", len(got), len(want))
+	}
+}
+
+// BenchmarkIdleSessions measures the CPU time burned by a server holding many idle sessions.
+// Each op just sleeps, so cpu-ms/op should be close to zero when the workers are blocked.
+func BenchmarkIdleSessions(b *testing.B) {
+	const sessions = 200
+	const idlePeriod = 100 * time.Millisecond
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+	for i := 0; i < sessions; i++ {
+		s := newSession(conn.LocalAddr(), i, conn, (*Config)(nil).withDefaults(), func(*Session) {}, false)
+		defer s.Abort()
+	}
+
+	b.ResetTimer()
+	start := cpuTime(b)
+	for i := 0; i < b.N; i++ {
+		time.Sleep(idlePeriod)
+	}
+	used := cpuTime(b) - start
+	b.StopTimer()
+	b.ReportMetric(float64(used.Milliseconds())/float64(b.N), "cpu-ms/op")
+}
+
+// cpuTime returns the user and system CPU time consumed by this process so far.
+func cpuTime(b *testing.B) time.Duration {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		b.Fatal(err)
+	}
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+}
+
+// pipePeer is a bare LRCP peer for driving a Listener's sessions by hand over an
+// in-memory pipe, so tests see exactly which messages a session sends, and when.
+type pipePeer struct {
+	t    *testing.T
+	l    *Listener
+	conn *lrcptest.PacketConn
+}
+
+// newPipePeer starts a Listener with config at the other end of a pipe from the peer.
+// The Listener is closed when the test ends.
+func newPipePeer(t *testing.T, config *Config) *pipePeer {
+	serverConn, conn := lrcptest.Pipe()
+	l := NewListener(serverConn, config)
+	t.Cleanup(func() { l.Close() })
+	return &pipePeer{t: t, l: l, conn: conn}
+}
+
+// send sends a raw message to the Listener.
+func (p *pipePeer) send(msg string) {
+	p.t.Helper()
+	if _, err := p.conn.WriteTo([]byte(msg), p.l.Addr()); err != nil {
+		p.t.Fatal(err)
+	}
+}
+
+// expect waits up to d for a message from the Listener, returning nil if none arrives.
+func (p *pipePeer) expect(d time.Duration) *message {
+	p.t.Helper()
+	buf := make([]byte, maxMessageSize)
+	p.conn.SetReadDeadline(time.Now().Add(d))
+	n, _, err := p.conn.ReadFrom(buf)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return nil
+	} else if err != nil {
+		p.t.Fatal(err)
+	}
+	msg, err := parseMessage(buf[:n])
+	if err != nil {
+		p.t.Fatalf("unexpected message %q: %v", buf[:n], err)
+	}
+	return msg
+}
+
+// expectAck waits up to d for an ack, returning its length, or -1 if nothing arrives.
+func (p *pipePeer) expectAck(d time.Duration) int {
+	p.t.Helper()
+	msg := p.expect(d)
+	if msg == nil {
+		return -1
+	}
+	if msg.Type != `ack` {
+		p.t.Fatalf("expected an ack, got %+v", msg)
+	}
+	return msg.Length
+}
+
+// expectData waits up to d for a data message, returning it, or nil if nothing arrives.
+func (p *pipePeer) expectData(d time.Duration) *message {
+	p.t.Helper()
+	msg := p.expect(d)
+	if msg != nil && msg.Type != `data` {
+		p.t.Fatalf("expected data, got %+v", msg)
+	}
+	return msg
+}
+
+// connect opens session id, and returns the Listener's end of it once acked.
+func (p *pipePeer) connect(id int) *Session {
+	p.t.Helper()
+	p.send(fmt.Sprintf(`/connect/%d/`, id))
+	if got := p.expectAck(time.Second); got != 0 {
+		p.t.Fatalf("expected connect ack, got %d", got)
+	}
+	s, err := p.l.AcceptLRCP()
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	return s
+}
+
+// TestDelayedAcks checks which data messages are acknowledged immediately and which are held back.
+func TestDelayedAcks(t *testing.T) {
+	peer := newPipePeer(t, &Config{AckEvery: 3, AckDelay: time.Second})
+	peer.connect(1234)
+
+	// Every third in-order message is acked straight away.
+	peer.send(`/data/1234/0/a/`)
+	peer.send(`/data/1234/1/b/`)
+	peer.send(`/data/1234/2/c/`)
+	if got := peer.expectAck(500 * time.Millisecond); got != 3 {
+		t.Fatalf("expected ack of 3 after three messages, got %d", got)
+	}
+
+	// Fewer than that are acked once AckDelay passes.
+	peer.send(`/data/1234/3/d/`)
+	if got := peer.expectAck(100 * time.Millisecond); got != -1 {
+		t.Fatalf("expected ack to be held, got %d", got)
+	}
+	if got := peer.expectAck(2 * time.Second); got != 4 {
+		t.Fatalf("expected delayed ack of 4, got %d", got)
+	}
+
+	// Out-of-order, gap-filling and duplicate data are acked immediately.
+	peer.send(`/data/1234/5/f/`)
+	if got := peer.expectAck(500 * time.Millisecond); got != 4 {
+		t.Fatalf("expected immediate ack of 4 for out-of-order data, got %d", got)
+	}
+	peer.send(`/data/1234/4/e/`)
+	if got := peer.expectAck(500 * time.Millisecond); got != 6 {
+		t.Fatalf("expected immediate ack of 6 once the gap is filled, got %d", got)
+	}
+	peer.send(`/data/1234/0/a/`)
+	if got := peer.expectAck(500 * time.Millisecond); got != 6 {
+		t.Fatalf("expected immediate ack of 6 for duplicate data, got %d", got)
+	}
+}
+
+// TestWriteCoalescing checks that small writes are held back while data is
+// unacknowledged, unless SetNoDelay is set.
+func TestWriteCoalescing(t *testing.T) {
+	// Long retransmission timeouts, so that only coalescing decides when data is sent.
+	peer := newPipePeer(t, &Config{CoalesceDelay: 300 * time.Millisecond, RetransmissionTimeout: 5 * time.Second, MinRetransmissionTimeout: 5 * time.Second})
+	server := peer.connect(1234)
+	// expectData returns the data of the next data message, or "" if none arrives within d.
+	expectData := func(d time.Duration) string {
+		t.Helper()
+		if msg := peer.expectData(d); msg != nil {
+			return string(msg.Data)
+		}
+		return ""
+	}
+
+	// The first write goes straight out; later ones wait for it to be acked.
+	server.Write([]byte("a"))
+	if got := expectData(time.Second); got != "a" {
+		t.Fatalf(`expected "a", got %q`, got)
+	}
+	server.Write([]byte("b"))
+	server.Write([]byte("c"))
+	if got := expectData(100 * time.Millisecond); got != "" {
+		t.Fatalf("expected writes to be held, got %q", got)
+	}
+	peer.send(`/ack/1234/1/`)
+	if got := expectData(time.Second); got != "bc" {
+		t.Fatalf(`expected "bc" once acked, got %q`, got)
+	}
+
+	// Without an ack, held data goes out after CoalesceDelay.
+	server.Write([]byte("d"))
+	if got := expectData(100 * time.Millisecond); got != "" {
+		t.Fatalf("expected write to be held, got %q", got)
+	}
+	if got := expectData(time.Second); got != "d" {
+		t.Fatalf(`expected "d" after CoalesceDelay, got %q`, got)
+	}
+
+	// With NoDelay, writes go straight out despite unacknowledged data.
+	server.SetNoDelay(true)
+	server.Write([]byte("e"))
+	if got := expectData(100 * time.Millisecond); got != "e" {
+		t.Fatalf(`expected "e" without delay, got %q`, got)
+	}
+}
+
+// TestFastRetransmit checks that duplicate acks resend only the segment the peer is missing.
+func TestFastRetransmit(t *testing.T) {
+	// Long retransmission timeouts, so that only duplicate acks cause resends.
+	peer := newPipePeer(t, &Config{RetransmissionTimeout: 5 * time.Second, MinRetransmissionTimeout: 5 * time.Second})
+	server := peer.connect(1234)
+	// expectData returns the position of the next data message, or -1 if none arrives within d.
+	expectData := func(d time.Duration) int {
+		t.Helper()
+		if msg := peer.expectData(d); msg != nil {
+			return msg.Pos
+		}
+		return -1
+	}
+
+	server.SetNoDelay(true)
+	server.Write(bytes.Repeat([]byte("x"), 4*maxSegmentSize))
+	if got := expectData(time.Second); got != 0 {
+		t.Fatalf("expected data at 0, got %d", got)
+	}
+	for expectData(100*time.Millisecond) > 0 {
+	}
+
+	// The first segment was "lost"; the peer acks 0 for each of the others.
+	for i := 1; i < dupAckThreshold; i++ {
+		peer.send(`/ack/1234/0/`)
+	}
+	if got := expectData(100 * time.Millisecond); got != -1 {
+		t.Fatalf("expected no resend before %d duplicate acks, got data at %d", dupAckThreshold, got)
+	}
+	peer.send(`/ack/1234/0/`)
+	if got := expectData(time.Second); got != 0 {
+		t.Fatalf("expected fast retransmit of data at 0, got %d", got)
+	}
+	if got := expectData(100 * time.Millisecond); got != -1 {
+		t.Fatalf("expected only the missing segment to be resent, got data at %d", got)
+	}
+	if got := server.Stats().FastRetransmits; got != 1 {
+		t.Fatalf("expected 1 fast retransmit, got %d", got)
+	}
+}
+
+// TestSendBuffer checks that Write blocks once the send buffer is full,
+// until acks make room or the write fails.
+func TestSendBuffer(t *testing.T) {
+	peer := newPipePeer(t, &Config{SendBufferSize: 10})
+	server := peer.connect(1234)
+
+	// Only what fits is buffered before the deadline.
+	server.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+	if n, err := server.Write(bytes.Repeat([]byte("x"), 15)); n != 10 || !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected 10 bytes and deadline exceeded, got %d, %v", n, err)
+	}
+
+	// A partial ack makes room for that much, even though the acked bytes
+	// haven't been discarded from the buffer yet.
+	peer.send(`/ack/1234/4/`)
+	server.SetWriteDeadline(time.Now().Add(time.Second))
+	if n, err := server.Write([]byte("yyyy")); n != 4 || err != nil {
+		t.Fatalf("expected 4 bytes written after a partial ack, got %d, %v", n, err)
+	}
+	server.SetWriteDeadline(time.Time{})
+
+	// A blocked Write completes once the peer acks enough.
+	done := make(chan error, 1)
+	go func() {
+		_, err := server.Write([]byte("yyyyy"))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("expected write to block on a full send buffer, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	peer.send(`/ack/1234/14/`)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("unexpected write error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("write still blocked after ack")
+	}
+
+	// And fails if the session closes while it's blocked.
+	go func() {
+		_, err := server.Write(bytes.Repeat([]byte("z"), 10))
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	server.Abort()
+	select {
+	case err := <-done:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Fatalf("expected net.ErrClosed, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("write still blocked after abort")
+	}
+}
+
+// TestIdleRTO checks that the retransmission timeout isn't backed off once everything is acked.
+func TestIdleRTO(t *testing.T) {
+	config := &Config{RetransmissionTimeout: 100 * time.Millisecond, MinRetransmissionTimeout: 100 * time.Millisecond}
+
+	t.Run("server", func(t *testing.T) {
+		peer := newPipePeer(t, config)
+		server := peer.connect(1234)
+		server.Write([]byte("a"))
+		if msg := peer.expectData(time.Second); msg == nil {
+			t.Fatal("expected data")
+		}
+		peer.send(`/ack/1234/1/`)
+		time.Sleep(3 * config.RetransmissionTimeout)
+		if got := server.RTO(); got != config.RetransmissionTimeout {
+			t.Fatalf("expected RTO of %s after idling, got %s", config.RetransmissionTimeout, got)
+		}
+	})
+
+	t.Run("client", func(t *testing.T) {
+		// The timer that was waiting on the connect ack mustn't fire afterwards either.
+		serverConn, clientConn := lrcptest.Pipe()
+		l := NewListener(serverConn, config)
+		defer l.Close()
+		d := &Dialer{Config: config}
+		defer d.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		client, err := d.DialPacketConn(ctx, clientConn, serverConn.LocalAddr())
+		if err != nil {
+			t.Fatalf("unexpected dial error: %v", err)
+		}
+		defer client.Abort()
+		time.Sleep(3 * config.RetransmissionTimeout)
+		if got := client.RTO(); got != config.RetransmissionTimeout {
+			t.Fatalf("expected RTO of %s after idling, got %s", config.RetransmissionTimeout, got)
+		}
+	})
+}
+
+// TestKeepAlive checks that keepalives hold an idle session open past ReadTimeout,
+// and that a session expires once its probes go unanswered.
+func TestKeepAlive(t *testing.T) {
+	// idle checks that a session stays open while idle for several ReadTimeouts,
+	// given the KeepAlive (if any) at each end.
+	idle := func(t *testing.T, serverKeepAlive, clientKeepAlive time.Duration) {
+		const readTimeout = 200 * time.Millisecond
+		serverConn, clientConn := lrcptest.Pipe()
+		l := NewListener(serverConn, &Config{ReadTimeout: readTimeout, KeepAlive: serverKeepAlive})
+		defer l.Close()
+		d := &Dialer{Config: &Config{ReadTimeout: readTimeout, KeepAlive: clientKeepAlive}}
+		defer d.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		client, err := d.DialPacketConn(ctx, clientConn, serverConn.LocalAddr())
+		if err != nil {
+			t.Fatalf("unexpected dial error: %v", err)
+		}
+		defer client.Abort()
+		s, err := l.AcceptLRCP()
+		if err != nil {
+			t.Fatalf("unexpected accept error: %v", err)
+		}
+
+		time.Sleep(3 * readTimeout)
+		if _, err := client.Write([]byte("ping")); err != nil {
+			t.Fatalf("unexpected write error after idling: %v", err)
+		}
+		s.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(s, buf); err != nil || string(buf) != "ping" {
+			t.Fatalf(`expected "ping" after idling, got %q, %v`, buf, err)
+		}
+	}
+	t.Run("idle", func(t *testing.T) {
+		idle(t, 50*time.Millisecond, 70*time.Millisecond)
+	})
+	// Probes are answered by a peer without keepalives of its own.
+	t.Run("idle server only", func(t *testing.T) {
+		idle(t, 50*time.Millisecond, 0)
+	})
+	t.Run("idle client only", func(t *testing.T) {
+		idle(t, 0, 50*time.Millisecond)
+	})
+
+	t.Run("connecting", func(t *testing.T) {
+		// Dial a bare server that takes its time acking the connect.
+		clientConn, serverConn := lrcptest.Pipe()
+		d := &Dialer{Config: &Config{KeepAlive: 50 * time.Millisecond}}
+		defer d.Close()
+		type dialResult struct {
+			s   *Session
+			err error
+		}
+		dialed := make(chan dialResult, 1)
+		go func() {
+			s, err := d.DialPacketConn(context.Background(), clientConn, serverConn.LocalAddr())
+			dialed <- dialResult{s, err}
+		}()
+
+		buf := make([]byte, maxMessageSize)
+		// read waits up to d for a message from the client, returning nil if none arrives.
+		read := func(d time.Duration) *message {
+			t.Helper()
+			serverConn.SetReadDeadline(time.Now().Add(d))
+			n, _, err := serverConn.ReadFrom(buf)
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				return nil
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			msg, err := parseMessage(buf[:n])
+			if err != nil {
+				t.Fatal(err)
+			}
+			return msg
+		}
+		connect := read(time.Second)
+		if connect == nil || connect.Type != `connect` {
+			t.Fatalf("expected a connect, got %+v", connect)
+		}
+		// No probes until the connect is acked; only (later) a retried connect.
+		if msg := read(300 * time.Millisecond); msg != nil {
+			t.Fatalf("expected nothing while connecting, got %+v", msg)
+		}
+		if _, err := serverConn.WriteTo([]byte(fmt.Sprintf(`/ack/%d/0/`, connect.Session)), clientConn.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+		r := <-dialed
+		if r.err != nil {
+			t.Fatalf("unexpected dial error: %v", r.err)
+		}
+		defer r.s.Abort()
+		// Once connected, the idle client probes.
+		if msg := read(time.Second); msg == nil || msg.Type != `data` || msg.Pos != 0 || len(msg.Data) != 0 {
+			t.Fatalf("expected a keepalive once connected, got %+v", msg)
+		}
+	})
+
+	t.Run("unanswered", func(t *testing.T) {
+		// A bare peer that never answers.
+		peer := newPipePeer(t, &Config{ReadTimeout: 10 * time.Second, KeepAlive: 50 * time.Millisecond})
+		start := time.Now()
+		s := peer.connect(1234)
+		// Each probe is empty data at the acked length, which any peer must ack.
+		var probes int
+		for msg := peer.expect(time.Second); msg != nil && msg.Type == `data`; msg = peer.expect(time.Second) {
+			if msg.Pos != 0 || len(msg.Data) != 0 {
+				t.Fatalf("unexpected probe %+v", msg)
+			}
+			probes++
+		}
+		if probes != KeepAliveProbes {
+			t.Fatalf("unexpected probes: got %d, want %d", probes, KeepAliveProbes)
+		}
+		if _, err := s.Read(make([]byte, 1)); err != io.EOF {
+			t.Fatalf("expected io.EOF once probes went unanswered, got %v", err)
+		}
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Fatalf("session took %s to expire", elapsed)
+		}
+	})
+}
@@ -0,0 +1,159 @@
+package lrcp
+
+import "sync/atomic"
+
+// Stats is a snapshot of a Session's transport counters, for diagnosing slow or lossy sessions.
+type Stats struct {
+	// Datagrams sent to and received from the peer, and their total size in bytes.
+	MessagesSent     int64
+	BytesSent        int64
+	MessagesReceived int64
+	BytesReceived    int64
+
+	// AcksSent counts the ack messages among MessagesSent.
+	AcksSent int64
+	// Retransmissions counts data (and connect) messages sent more than once.
+	Retransmissions int64
+	// FastRetransmits counts the times duplicate acks caused a data message to be resent
+	// early; those resends are also counted in Retransmissions.
+	FastRetransmits int64
+	// DuplicateAcks counts acks that didn't acknowledge anything new.
+	DuplicateAcks int64
+	// DuplicateData counts data messages containing nothing we hadn't already received.
+	DuplicateData int64
+	// OutOfOrder counts data messages that arrived ahead of a gap and were held in the reorder buffer.
+	OutOfOrder int64
+	// OutOfOrderDrops counts data messages that arrived ahead of a gap and were dropped
+	// because they didn't fit in the reorder buffer.
+	OutOfOrderDrops int64
+	// WindowDrops counts data messages refused, in whole or in part, because they
+	// extended beyond the receive window (see Config.ReceiveWindow.)
+	WindowDrops int64
+	// ReceiveDrops counts messages dropped because the session's receive channel was full.
+	ReceiveDrops int64
+
+	// LastAck is the length last acknowledged by the peer (-1 for a client awaiting its connect ack.)
+	LastAck int
+	// MaxAckable is the most data sent to the peer, i.e. the greatest length it may acknowledge.
+	MaxAckable int
+}
+
+// add returns the sum of s and o.
+func (s Stats) add(o Stats) Stats {
+	return Stats{
+		MessagesSent:     s.MessagesSent + o.MessagesSent,
+		BytesSent:        s.BytesSent + o.BytesSent,
+		MessagesReceived: s.MessagesReceived + o.MessagesReceived,
+		BytesReceived:    s.BytesReceived + o.BytesReceived,
+		AcksSent:         s.AcksSent + o.AcksSent,
+		Retransmissions:  s.Retransmissions + o.Retransmissions,
+		FastRetransmits:  s.FastRetransmits + o.FastRetransmits,
+		DuplicateAcks:    s.DuplicateAcks + o.DuplicateAcks,
+		DuplicateData:    s.DuplicateData + o.DuplicateData,
+		OutOfOrder:       s.OutOfOrder + o.OutOfOrder,
+		OutOfOrderDrops:  s.OutOfOrderDrops + o.OutOfOrderDrops,
+		WindowDrops:      s.WindowDrops + o.WindowDrops,
+		ReceiveDrops:     s.ReceiveDrops + o.ReceiveDrops,
+		LastAck:          s.LastAck + o.LastAck,
+		MaxAckable:       s.MaxAckable + o.MaxAckable,
+	}
+}
+
+// ListenerStats aggregates Stats across a Listener's open sessions.
+type ListenerStats struct {
+	// Sessions is the number of open sessions.
+	Sessions int
+	// Totals sums the Stats of every open session. Note that LastAck and MaxAckable
+	// are summed too, giving the total data acknowledged by and sent to all peers.
+	Totals Stats
+
+	// Connects refused since the Listener started, by reason: the admission limits
+	// of Config, or a full accept queue (see Config.AcceptBufferSize.)
+	RejectedMaxSessions          int64
+	RejectedMaxSessionsPerSource int64
+	RejectedConnectRate          int64
+	RejectedAcceptQueueFull      int64
+
+	// Messages dropped by a hardened Listener (see Config.Hardened): data and acks outside
+	// a session's window, and closes over the rate limit.
+	DroppedOutOfWindow int64
+	DroppedCloses      int64
+}
+
+// rejectStats counts a Listener's refused connects by reason, and messages dropped when hardened.
+type rejectStats struct {
+	maxSessions          atomic.Int64
+	maxSessionsPerSource atomic.Int64
+	connectRate          atomic.Int64
+	acceptQueueFull      atomic.Int64
+	outOfWindow          atomic.Int64
+	closeRate            atomic.Int64
+}
+
+// sessionStats holds a Session's live counters. Updated by several goroutines, hence atomics.
+type sessionStats struct {
+	messagesSent     atomic.Int64
+	bytesSent        atomic.Int64
+	messagesReceived atomic.Int64
+	bytesReceived    atomic.Int64
+	acksSent         atomic.Int64
+	retransmissions  atomic.Int64
+	fastRetransmits  atomic.Int64
+	duplicateAcks    atomic.Int64
+	duplicateData    atomic.Int64
+	outOfOrder       atomic.Int64
+	outOfOrderDrops  atomic.Int64
+	windowDrops      atomic.Int64
+	receiveDrops     atomic.Int64
+}
+
+// sent records a datagram of n bytes sent to the peer.
+func (c *sessionStats) sent(n int) {
+	c.messagesSent.Add(1)
+	c.bytesSent.Add(int64(n))
+}
+
+// received records a datagram of n bytes received from the peer.
+func (c *sessionStats) received(n int) {
+	c.messagesReceived.Add(1)
+	c.bytesReceived.Add(int64(n))
+}
+
+// Stats returns a snapshot of the session's transport counters.
+func (s *Session) Stats() Stats {
+	return Stats{
+		MessagesSent:     s.stats.messagesSent.Load(),
+		BytesSent:        s.stats.bytesSent.Load(),
+		MessagesReceived: s.stats.messagesReceived.Load(),
+		BytesReceived:    s.stats.bytesReceived.Load(),
+		AcksSent:         s.stats.acksSent.Load(),
+		Retransmissions:  s.stats.retransmissions.Load(),
+		FastRetransmits:  s.stats.fastRetransmits.Load(),
+		DuplicateAcks:    s.stats.duplicateAcks.Load(),
+		DuplicateData:    s.stats.duplicateData.Load(),
+		OutOfOrder:       s.stats.outOfOrder.Load(),
+		OutOfOrderDrops:  s.stats.outOfOrderDrops.Load(),
+		WindowDrops:      s.stats.windowDrops.Load(),
+		ReceiveDrops:     s.stats.receiveDrops.Load(),
+		LastAck:          int(s.lastAck.Load()),
+		MaxAckable:       int(s.maxAckable.Load()),
+	}
+}
+
+// Stats returns the number of open sessions and the sum of their transport counters.
+// Sessions that have closed are no longer counted.
+func (l *Listener) Stats() ListenerStats {
+	var stats ListenerStats
+	l.sessionStore.Range(func(_, value any) bool {
+		stats.Sessions++
+		stats.Totals = stats.Totals.add(value.(*Session).Stats())
+		return true
+	})
+	stats.RejectedMaxSessions = l.rejected.maxSessions.Load()
+	stats.RejectedMaxSessionsPerSource = l.rejected.maxSessionsPerSource.Load()
+	stats.RejectedConnectRate = l.rejected.connectRate.Load()
+	stats.RejectedAcceptQueueFull = l.rejected.acceptQueueFull.Load()
+	stats.DroppedOutOfWindow = l.rejected.outOfWindow.Load()
+	stats.DroppedCloses = l.rejected.closeRate.Load()
+	return stats
+}
@@ -0,0 +1,71 @@
+package lrcp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestStats(t *testing.T) {
+	l, err := Listen("lrcp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// Drive the server by hand so we know exactly what it sees.
+	conn, err := net.DialUDP("udp", nil, l.Addr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	messages := []string{
+		`/connect/1234/`,
+		`/data/1234/0/abc/`,
+		`/data/1234/0/abc/`,                    // duplicate
+		`/data/1234/10/xyz/`,                   // out of order
+		`/data/1234/100000/xyz/`,               // beyond the reorder buffer
+		`/data/1234/` + `2147483000` + `/xyz/`, // way beyond the receive window
+		`/ack/1234/0/`,                         // duplicate ack; nothing's been sent
+	}
+	bytesSent := 0
+	for _, msg := range messages {
+		if _, err := conn.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		bytesSent += len(msg)
+		time.Sleep(5 * time.Millisecond) // Don't overrun the session's receive channel
+	}
+
+	want := Stats{
+		MessagesReceived: int64(len(messages)),
+		BytesReceived:    int64(bytesSent),
+		DuplicateAcks:    1,
+		DuplicateData:    1,
+		OutOfOrder:       1,
+		OutOfOrderDrops:  1,
+		WindowDrops:      1,
+		// One ack for the connect, and one for each data message.
+		MessagesSent: 6,
+		AcksSent:     6,
+	}
+	deadline := time.Now().Add(time.Second)
+	var got ListenerStats
+	for time.Now().Before(deadline) {
+		got = l.Stats()
+		got.Totals.BytesSent = 0 // Depends on ack lengths; just check it's counted below.
+		if got.Sessions == 1 && got.Totals == want {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got.Sessions != 1 {
+		t.Fatalf("unexpected session count: got %d, want 1", got.Sessions)
+	}
+	if got.Totals != want {
+		t.Fatalf("unexpected stats:\ngot  %+v\nwant %+v", got.Totals, want)
+	}
+	if l.Stats().Totals.BytesSent == 0 {
+		t.Fatalf("expected bytes sent to be counted")
+	}
+}
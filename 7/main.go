@@ -3,29 +3,67 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"flag"
 	"log"
 	"net"
 	"slices"
+
+	"lrcp/lrcp"
 )
 
 var (
-	localAddr = "0.0.0.0"
+	// Empty to listen on all addresses, IPv4 and IPv6.
+	localAddr = ""
 	localPort = 4321
 )
 
 func main() {
+	config := &lrcp.Config{}
+	flag.IntVar(&localPort, "port", localPort, "UDP port to listen on")
+	flag.DurationVar(&config.RetransmissionTimeout, "rto", lrcp.RetransmissionTimeout, "retransmission timeout until round trip times are measured")
+	flag.DurationVar(&config.MinRetransmissionTimeout, "min-rto", lrcp.MinRetransmissionTimeout, "lower bound on the retransmission timeout")
+	flag.DurationVar(&config.MaxRetransmissionTimeout, "max-rto", lrcp.MaxRetransmissionTimeout, "upper bound on the retransmission timeout")
+	flag.DurationVar(&config.ReadTimeout, "read-timeout", lrcp.ReadTimeout, "session expiry timeout")
+	flag.DurationVar(&config.KeepAlive, "keepalive", 0, "idle time before sending keepalive probes (0 to disable)")
+	flag.IntVar(&config.KeepAliveProbes, "keepalive-probes", lrcp.KeepAliveProbes, "unanswered keepalive probes before a session expires")
+	flag.IntVar(&config.ReceiveBufferSize, "receive-buffer", lrcp.ReceiveBufferSize, "incoming messages queued per session")
+	flag.IntVar(&config.ReorderBufferSize, "reorder-buffer", lrcp.ReorderBufferSize, "out-of-order bytes buffered per session")
+	flag.IntVar(&config.ReceiveWindow, "receive-window", lrcp.ReceiveWindow, "unread bytes accepted per session")
+	flag.IntVar(&config.SendBufferSize, "send-buffer", lrcp.SendBufferSize, "unacknowledged bytes buffered per session before writes block")
+	flag.IntVar(&config.AckEvery, "ack-every", lrcp.AckEvery, "acknowledge every n in-order data messages")
+	flag.DurationVar(&config.AckDelay, "ack-delay", lrcp.AckDelay, "longest an acknowledgement is held back (with -ack-every > 1)")
+	flag.BoolVar(&config.NoDelay, "no-delay", false, "send small writes immediately instead of coalescing them")
+	flag.DurationVar(&config.CoalesceDelay, "coalesce-delay", lrcp.CoalesceDelay, "longest a small write is held back for coalescing")
+	flag.IntVar(&config.AcceptBufferSize, "accept-buffer", lrcp.AcceptBufferSize, "new sessions queued for accept")
+	flag.IntVar(&config.MaxSessions, "max-sessions", 0, "maximum open sessions (0 for no limit)")
+	flag.IntVar(&config.MaxSessionsPerSource, "max-sessions-per-source", 0, "maximum open sessions per source IP (0 for no limit)")
+	flag.Float64Var(&config.ConnectRate, "connect-rate", 0, "new sessions per second per source IP (0 for no limit)")
+	flag.IntVar(&config.ConnectBurst, "connect-burst", 1, "burst allowed by -connect-rate")
+	flag.BoolVar(&config.Hardened, "hardened", false, "drop out-of-window messages and rate limit closes, against spoofed packets")
+	flag.Float64Var(&config.CloseRate, "close-rate", lrcp.CloseRate, "closes per second per source IP (with -hardened)")
+	flag.IntVar(&config.CloseBurst, "close-burst", lrcp.CloseBurst, "burst allowed by -close-rate")
+	flag.Parse()
+
 	laddr := &net.UDPAddr{
 		IP:   net.ParseIP(localAddr),
 		Port: localPort,
 		Zone: "",
 	}
 
-	l, err := Listen(laddr)
+	l, err := lrcp.Listen("lrcp", laddr, config)
 	if err != nil {
 		log.Fatalf(`error listening: %s`, err)
 	}
+	log.Fatal(serve(l))
+}
+
+// serve accepts sessions until the listener is closed, handing each to reverseSessionHandler.
+func serve(l *lrcp.Listener) error {
 	for {
-		session := l.Accept()
+		session, err := l.AcceptLRCP()
+		if err != nil {
+			return err
+		}
 		log.Printf(`accepted session [%s]`, session.Key())
 
 		go reverseSessionHandler(session)
@@ -34,13 +72,13 @@ func main() {
 
 // reverseSessionHandler implements the application layer by simply reading until a new line
 // and then responding with a reversed copy of each line.
-func reverseSessionHandler(session *Session) {
+func reverseSessionHandler(session *lrcp.Session) {
 	defer session.Close()
 
 	scanner := bufio.NewScanner(session)
-	// Default token size is 64k, but we might receive maxInt bytes before newline.
-	// Start with 2^16, allow growth to maxInt.
-	scanner.Buffer(make([]byte, 65536), maxInt)
+	// Default token size is 64k, but we might receive lrcp.MaxStreamLength bytes before newline.
+	// Start with 2^16, allow growth to lrcp.MaxStreamLength.
+	scanner.Buffer(make([]byte, 65536), lrcp.MaxStreamLength)
 	scanner.Split(ScanLinesNoCR)
 
 	for scanner.Scan() {
@@ -51,7 +89,6 @@ func reverseSessionHandler(session *Session) {
 		_, err := session.Write(data)
 		if err != nil {
 			log.Printf(`Reverse: Session[%s] encountered error on write: %s`, session.Key(), err)
-			session.SendClose()
 			break
 		}
 		log.Printf(`Reverse: Session[%s] sent [%d] bytes`, session.Key(), len(data))
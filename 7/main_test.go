@@ -3,26 +3,42 @@ package main
 import (
 	"bufio"
 	"bytes"
-	"context"
-	cryptoRand "crypto/rand"
 	"encoding/hex"
-	"fmt"
+	"flag"
 	"io"
 	"log"
 	"math/rand"
 	"net"
+	"net/textproto"
 	"os"
 	"slices"
-	"sync"
 	"testing"
 	"time"
+
+	"lrcp/lrcp"
+	"lrcp/lrcp/lrcptest"
 )
 
+// testConfig is used by the test server and by TestBadLink's client.
+var testConfig = &lrcp.Config{}
+
+func init() {
+	flag.IntVar(&testConfig.AckEvery, "ack-every", lrcp.AckEvery, "acknowledge every n data messages (see lrcp.Config)")
+}
+
 func TestMain(m *testing.M) {
+	flag.Parse()
 	localAddr = "127.0.0.1"
-	go main()
-	time.Sleep(50 * time.Millisecond)
+	l, err := lrcp.Listen("lrcp", &net.UDPAddr{
+		IP:   net.ParseIP(localAddr),
+		Port: localPort,
+	}, testConfig)
+	if err != nil {
+		log.Fatalf(`error listening: %s`, err)
+	}
+	go serve(l)
 	v := m.Run()
+	l.Close()
 	os.Exit(v)
 }
 
@@ -85,7 +101,7 @@ func TestBasic(t *testing.T) {
 
 		t.Run(testCase.Name, func(t *testing.T) {
 			t.Parallel()
-			s, err := DialLRCP("lrcp", nil, raddr)
+			s, err := lrcp.Dial("lrcp", nil, raddr)
 			if err != nil {
 				t.Fatalf("unexpected dial error: %v", err)
 			}
@@ -120,18 +136,85 @@ func TestBasic(t *testing.T) {
 	}
 }
 
+// TestNetConn checks that a Session works with code written for TCP connections.
+func TestNetConn(t *testing.T) {
+	t.Parallel()
+
+	raddr := &net.UDPAddr{
+		IP:   net.ParseIP(localAddr),
+		Port: 4321,
+	}
+	s, err := lrcp.Dial("lrcp", nil, raddr)
+	if err != nil {
+		t.Fatalf("unexpected dial error: %v", err)
+	}
+	defer s.Close()
+	s.SetDeadline(time.Now().Add(5 * time.Second))
+
+	conn := textproto.NewConn(s)
+	if err := conn.PrintfLine("hello %s", "world"); err != nil {
+		t.Fatalf("unexpected write error: %v", err)
+	}
+	// textproto terminates lines with \r\n, and the reversal keeps the \r.
+	got, err := conn.ReadLine()
+	if err != nil {
+		t.Fatalf("unexpected read error: %v", err)
+	}
+	if want := "\rdlrow olleh"; got != want {
+		t.Fatalf("unexpected line: got %q, want %q", got, want)
+	}
+}
+
+var seed = flag.Int64("seed", 0, "seed for TestBadLink data and impairments; 0 picks one from the clock")
+
 func TestBadLink(t *testing.T) {
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+	// Rerun a failure with the same data, and the same fate for each message: go test -run TestBadLink -seed <seed>
+	t.Logf(`TestBadLink: seed %d`, *seed)
+
+	links := []struct {
+		Name        string
+		Impairments lrcptest.Impairments
+	}{
+		{
+			Name:        "lossy",
+			Impairments: lrcptest.Impairments{Loss: 0.25},
+		},
+		{
+			Name: "messy",
+			Impairments: lrcptest.Impairments{
+				Loss:         0.05,
+				BurstLoss:    0.01,
+				BurstLength:  5,
+				Duplicate:    0.05,
+				Reorder:      0.05,
+				ReorderDelay: 20 * time.Millisecond,
+				Delay:        time.Millisecond,
+				Jitter:       4 * time.Millisecond,
+				Bandwidth:    1 << 20,
+			},
+		},
+	}
+	for _, link := range links {
+		link := link
+		link.Impairments.Seed = *seed
+		t.Run(link.Name, func(t *testing.T) {
+			testBadLink(t, link.Impairments)
+		})
+	}
+}
 
+func testBadLink(t *testing.T, imp lrcptest.Impairments) {
 	// Goal: generate a lot of data, write it, reverse it, scan it back
 
-	maxData := maxInt >> 16
+	maxData := lrcp.MaxStreamLength >> 16
 
 	// Generate data
 	log.Println(`TestBadLink: generating data`)
 	lines := make([][]byte, 0)
-	scanner := bufio.NewScanner(&RandReader{})
+	scanner := bufio.NewScanner(rand.New(rand.NewSource(imp.Seed)))
 	var bs, line []byte
 	for i := 0; i < maxData; {
 		scanner.Scan()
@@ -154,30 +237,23 @@ func TestBadLink(t *testing.T) {
 
 	// Connect to server via proxy
 	log.Println(`TestBadLink: connecting to proxy`)
-	proxyAddr := &net.UDPAddr{
-		IP:   net.ParseIP("127.0.0.1"),
-		Port: 9876,
-	}
 	serverAddr := &net.UDPAddr{
 		IP:   net.ParseIP(localAddr),
 		Port: 4321,
 	}
-	_, err := NewBadProxy(
-		ctx,
-		serverAddr,
-		proxyAddr,
-		25, // 25% failure rate
-	)
+	proxy, err := lrcptest.NewProxy(&net.UDPAddr{IP: net.ParseIP("127.0.0.1")}, serverAddr, imp)
 	if err != nil {
 		t.Fatalf(`failed to create proxy server: %v`, err)
 	}
-	time.Sleep(500 * time.Millisecond)
-	session, err := DialLRCP("lrcp", nil, proxyAddr)
+	defer proxy.Close()
+	dialer := &lrcp.Dialer{Config: testConfig}
+	session, err := dialer.Dial("lrcp", proxy.Addr())
 	// If you want to bypass the proxy entirely...
-	//session, err := DialLRCP("lrcp", nil, serverAddr)
+	//session, err := lrcp.Dial("lrcp", nil, serverAddr)
 	if err != nil {
 		t.Fatalf(`failed to dial proxy server: %v`, err)
 	}
+	defer session.Abort()
 
 	writeStatusCh := make(chan bool)
 	// Write data
@@ -203,7 +279,7 @@ func TestBadLink(t *testing.T) {
 
 	log.Println(`TestBadLink: receiving and checking results`)
 	scanner = bufio.NewScanner(session)
-	scanner.Buffer(make([]byte, 65536), maxInt)
+	scanner.Buffer(make([]byte, 65536), lrcp.MaxStreamLength)
 	scanner.Split(ScanLinesNoCR)
 	var want []byte
 	for i := 0; i < len(lines) && scanner.Scan(); i++ {
@@ -227,159 +303,7 @@ func TestBadLink(t *testing.T) {
 			t.Fatalf(`received error from write goroutine`)
 		}
 	}
-}
-
-// RandReader provides a random Read() method in order to provide
-// a struct we can pass to a scanner
-type RandReader struct{}
-
-func (r *RandReader) Read(p []byte) (int, error) {
-	//TODO replace this with math/rand/v2/ChaCha8.Read after updating to go 1.23
-	// for deterministic output
-	return cryptoRand.Read(p)
-}
-
-type BadProxy struct {
-	ListenAddr *net.UDPAddr
-	ServerAddr *net.UDPAddr
-	FailRate   int
-	Clients    sync.Map
-	BufferPool sync.Pool
-}
-
-func NewBadProxy(ctx context.Context, serverAddr, listenAddr *net.UDPAddr, failRate int) (*BadProxy, error) {
-	if failRate > 99 {
-		return nil, fmt.Errorf("proxy has failure rate [%d] > 99; no traffic can pass.", failRate)
-	} else if failRate < 1 {
-		return nil, fmt.Errorf("proxy has failure rate [%d] < 1; Intn will panic.", failRate)
-	}
-	b := &BadProxy{
-		ListenAddr: listenAddr,
-		ServerAddr: serverAddr,
-		FailRate:   failRate,
-		BufferPool: sync.Pool{
-			New: func() interface{} {
-				b := make([]byte, 65535) // Max UDP packet size of 2**16
-				return &b
-			},
-		},
-	}
-	go b.listen(ctx)
-	return b, nil
-}
-
-// badProxy will listen on two addresses, fowarding packets between the two,
-// dropping an average of (failRate/100) packets at random.
-// Currently a dumb proxy that only supports a single client for simplicity.
-func (b *BadProxy) listen(ctx context.Context) {
-	bufSize := 65535 // Max UDP size
-
-	listenConn, err := net.ListenUDP("udp", b.ListenAddr)
-	if err != nil {
-		panic(err)
-	}
-	defer listenConn.Close()
-
-	ctx, cancel := context.WithCancel(ctx)
-	defer cancel()
-
-	// Forward to server
-	forward := func(ctx context.Context, serverConn *net.UDPConn, clientAddr *net.UDPAddr, ch chan *[]byte) {
-		defer serverConn.Close()
-		defer b.Clients.Delete(clientAddr.String())
-
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case bufPtr := <-ch:
-				// Forward to server
-				for n := len(*bufPtr); n > 0; {
-					wrote, err := serverConn.Write(*bufPtr)
-					if err != nil {
-						log.Printf(`badProxy: write error to [%v]: %v`, serverConn.RemoteAddr().String(), err)
-						break
-					}
-					n -= wrote
-				}
-				b.BufferPool.Put(bufPtr)
-				continue
-			}
-		}
-	}
-	reverse := func(ctx context.Context, serverConn *net.UDPConn, clientAddr *net.UDPAddr) {
-		defer serverConn.Close()
-
-		buf := make([]byte, bufSize)
-		// Listen for packets from server
-		// Server (connected) to proxy client (not connected)
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			default:
-			}
-			// Get a packet
-			buf = buf[:cap(buf)]
-			n, err := serverConn.Read(buf)
-			if err != nil {
-				log.Printf(`badProxy: read error from [%v]: %v`, b.ServerAddr, err)
-			}
-			buf = buf[:n]
-
-			// Roll the dice (1-100)
-			if rand.Intn(100)+1 <= b.FailRate {
-				continue
-			}
-			// Forward
-			for n > 0 {
-				wrote, err := listenConn.WriteTo(buf, clientAddr)
-				if err != nil {
-					log.Printf(`badProxy: write error to [%v]: %v`, clientAddr, err)
-				}
-				n -= wrote
-			}
-		}
-
-	}
-
-	// Get a packet
-	// Pass packet to forward goroutine
-	var buf *[]byte
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		default:
-		}
-		buf = b.BufferPool.Get().(*[]byte)
-		*buf = (*buf)[0:cap(*buf)]
-		// Read a packet
-		n, clientAddr, err := listenConn.ReadFrom(*buf)
-		if err != nil {
-			b.BufferPool.Put(&buf)
-			log.Printf(`badProxy: read error from [%v]: %v`, clientAddr, err)
-			continue
-		}
-		*buf = (*buf)[:n]
-		// Roll the dice (1-100)
-		if rand.Intn(100)+1 <= b.FailRate {
-			b.BufferPool.Put(buf)
-			continue
-		}
-		// Check client map
-		ch := make(chan *[]byte, 1)
-		actualCh, loaded := b.Clients.LoadOrStore(clientAddr.String(), ch)
-		if !loaded { // Kick off goroutines
-			serverConn, err := net.DialUDP("udp", nil, b.ServerAddr)
-			if err != nil {
-				log.Println(err)
-				return
-			}
-			go forward(ctx, serverConn, clientAddr.(*net.UDPAddr), actualCh.(chan *[]byte))
-			go reverse(ctx, serverConn, clientAddr.(*net.UDPAddr))
-		}
-		// Forward packet to handler to be written to server
-		actualCh.(chan *[]byte) <- buf
-	}
+	up, down := proxy.Stats()
+	t.Logf(`TestBadLink: proxy upstream %+v, downstream %+v`, up, down)
+	t.Logf(`TestBadLink: client %+v`, session.Stats())
 }